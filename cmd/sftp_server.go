@@ -0,0 +1,29 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/Fyve-Labs/tessa-daemon/internal/remote_commands/handler"
+	"github.com/spf13/cobra"
+)
+
+var (
+	sftpRoot         string
+	sftpAllowedPaths []string
+)
+
+// sftpServerCmd serves SFTP on stdin/stdout. It is started by the SSH server for sftp
+// subsystem requests, with the permissions of the session user.
+var sftpServerCmd = &cobra.Command{
+	Use:    handler.SFTPServerCommand,
+	Hidden: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return handler.ServeSFTP(os.Stdin, os.Stdout, sftpRoot, sftpAllowedPaths)
+	},
+}
+
+func init() {
+	sftpServerCmd.Flags().StringVar(&sftpRoot, "root", "", "Directory SFTP clients are confined to")
+	sftpServerCmd.Flags().StringArrayVar(&sftpAllowedPaths, "allow", nil, "Directory SFTP clients may access, repeatable")
+	rootCmd.AddCommand(sftpServerCmd)
+}
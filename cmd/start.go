@@ -95,7 +95,8 @@ func startServer(conf *config.Config) error {
 	}
 
 	slog.Info("Listening for commands...")
-	commandManager := remote_commands.NewCommandManager(nc, tunnelManager)
+	conf.Version = VERSION
+	commandManager := remote_commands.NewCommandManager(conf, nc, tunnelManager)
 	if err = commandManager.Initialize(); err != nil {
 		return errors.Wrap(err, "initialize Command Manager")
 	}
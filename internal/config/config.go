@@ -2,8 +2,10 @@ package config
 
 import (
 	"errors"
+	"fmt"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -12,7 +14,14 @@ import (
 )
 
 const defaultNatsURL = "tls://52.7.199.211:4222"
-const defaultTunnelAddr = "52.7.199.211"
+const (
+	defaultTunnelAddr     = "52.7.199.211"
+	defaultTunnelPort     = 7000
+	defaultTunnelProtocol = "tcp"
+)
+
+// tunnelProtocols are the transports frpc can reach the tunnel server with.
+var tunnelProtocols = []string{"tcp", "kcp", "quic", "websocket", "wss"}
 
 var DeviceName string
 
@@ -22,6 +31,15 @@ type Config struct {
 	NatsServerConfig *NatsServerConfig `yaml:"nats,omitempty"`
 	TunnelConfig     *TunnelConfig     `yaml:"tunnel,omitempty"`
 	TLS              *TLSConfig        `yaml:"tls"`
+	Commands         []CommandConfig   `yaml:"commands,omitempty"`
+	// Version is the daemon version, set at startup rather than read from the file.
+	Version string `yaml:"-"`
+}
+
+// CommandConfig is a remote command started with the daemon, e.g. enable-beszel.
+type CommandConfig struct {
+	Command string                 `yaml:"command"`
+	Payload map[string]interface{} `yaml:"payload,omitempty"`
 }
 
 type NatsServerConfig struct {
@@ -40,11 +58,110 @@ type TLSConfig struct {
 	CertFile string `yaml:"cert"`
 }
 
+// TunnelConfig is the frp client configuration. Unset fields use the frp defaults, and the
+// TESSA_TUNNEL_* environment variables override the file.
 type TunnelConfig struct {
-	ServerAddr  string
-	TLSCaFile   string
-	TLSKeyFile  string
-	TLSCertFile string
+	ServerAddr string `yaml:"serverAddr,omitempty"`
+	ServerPort int    `yaml:"serverPort,omitempty"`
+	// Protocol is tcp, kcp, quic, websocket or wss.
+	Protocol string `yaml:"protocol,omitempty"`
+	// TLSServerName is the name checked against the server certificate, when it differs from ServerAddr.
+	TLSServerName string `yaml:"tlsServerName,omitempty"`
+	// PoolCount is how many work connections are opened to the server in advance.
+	PoolCount int `yaml:"poolCount,omitempty"`
+	// HeartbeatInterval and HeartbeatTimeout turn on frp heartbeats, which are off by default as
+	// the stream multiplexer keeps the connection alive.
+	HeartbeatInterval time.Duration `yaml:"heartbeatInterval,omitempty"`
+	HeartbeatTimeout  time.Duration `yaml:"heartbeatTimeout,omitempty"`
+	// LoginTimeout limits connecting to the server.
+	LoginTimeout time.Duration `yaml:"loginTimeout,omitempty"`
+	// ProxyURL reaches the server through an HTTP, SOCKS5 or NTLM proxy, e.g. http://proxy:3128.
+	ProxyURL string `yaml:"proxyURL,omitempty"`
+
+	// The device TLS credentials, from the tls section
+	TLSCaFile   string `yaml:"-"`
+	TLSKeyFile  string `yaml:"-"`
+	TLSCertFile string `yaml:"-"`
+}
+
+func (c *TunnelConfig) Validate() error {
+	if c.ServerPort < 0 || c.ServerPort > 65535 {
+		return fmt.Errorf("invalid tunnel server port %d", c.ServerPort)
+	}
+
+	valid := false
+	for _, protocol := range tunnelProtocols {
+		valid = valid || c.Protocol == protocol
+	}
+	if !valid {
+		return fmt.Errorf("invalid tunnel protocol %q, must be one of %s", c.Protocol, strings.Join(tunnelProtocols, ", "))
+	}
+
+	if c.PoolCount < 0 {
+		return errors.New("tunnel pool count cannot be negative")
+	}
+
+	if c.LoginTimeout < 0 {
+		return errors.New("tunnel login timeout cannot be negative")
+	}
+
+	if c.ProxyURL != "" {
+		if _, err := url.Parse(c.ProxyURL); err != nil {
+			return fmt.Errorf("invalid tunnel proxy URL: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// applyEnv overrides the file settings with the TESSA_TUNNEL_* environment variables.
+func (c *TunnelConfig) applyEnv() error {
+	if val := os.Getenv("TESSA_TUNNEL_SERVER_ADDR"); val != "" {
+		c.ServerAddr = val
+	}
+
+	if val := os.Getenv("TESSA_TUNNEL_PROTOCOL"); val != "" {
+		c.Protocol = val
+	}
+
+	if val := os.Getenv("TESSA_TUNNEL_TLS_SERVER_NAME"); val != "" {
+		c.TLSServerName = val
+	}
+
+	if val := os.Getenv("TESSA_TUNNEL_PROXY_URL"); val != "" {
+		c.ProxyURL = val
+	}
+
+	ints := map[string]*int{
+		"TESSA_TUNNEL_SERVER_PORT": &c.ServerPort,
+		"TESSA_TUNNEL_POOL_COUNT":  &c.PoolCount,
+	}
+	for name, field := range ints {
+		if val := os.Getenv(name); val != "" {
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %w", name, err)
+			}
+			*field = n
+		}
+	}
+
+	durations := map[string]*time.Duration{
+		"TESSA_TUNNEL_HEARTBEAT_INTERVAL": &c.HeartbeatInterval,
+		"TESSA_TUNNEL_HEARTBEAT_TIMEOUT":  &c.HeartbeatTimeout,
+		"TESSA_TUNNEL_LOGIN_TIMEOUT":      &c.LoginTimeout,
+	}
+	for name, field := range durations {
+		if val := os.Getenv(name); val != "" {
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %w", name, err)
+			}
+			*field = d
+		}
+	}
+
+	return nil
 }
 
 func LoadConfig(cfgFile string) (*Config, error) {
@@ -68,17 +185,49 @@ func LoadConfig(cfgFile string) (*Config, error) {
 		return nil, errors.New("TLS credentials not found")
 	}
 
-	config.TunnelConfig = &TunnelConfig{
-		ServerAddr:  config.TunnelAddr(),
-		TLSCaFile:   config.TLS.CaFile,
-		TLSKeyFile:  config.TLS.KeyFile,
-		TLSCertFile: config.TLS.CertFile,
+	if err = config.loadTunnelConfig(); err != nil {
+		return nil, err
 	}
 
 	return &config, nil
 }
 
+// loadTunnelConfig completes the tunnel section with defaults, environment overrides and the
+// device TLS credentials.
+func (c *Config) loadTunnelConfig() error {
+	if c.TunnelConfig == nil {
+		c.TunnelConfig = &TunnelConfig{}
+	}
+
+	tunnel := c.TunnelConfig
+	if err := tunnel.applyEnv(); err != nil {
+		return err
+	}
+
+	if tunnel.ServerAddr == "" {
+		tunnel.ServerAddr = defaultTunnelAddr
+	}
+	if tunnel.ServerPort == 0 {
+		tunnel.ServerPort = defaultTunnelPort
+	}
+	if tunnel.Protocol == "" {
+		tunnel.Protocol = defaultTunnelProtocol
+	}
+
+	if c.TLS != nil {
+		tunnel.TLSCaFile = c.TLS.CaFile
+		tunnel.TLSKeyFile = c.TLS.KeyFile
+		tunnel.TLSCertFile = c.TLS.CertFile
+	}
+
+	return tunnel.Validate()
+}
+
 func (c *Config) TunnelAddr() string {
+	if c.TunnelConfig != nil && c.TunnelConfig.ServerAddr != "" {
+		return c.TunnelConfig.ServerAddr
+	}
+
 	if val := os.Getenv("TESSA_TUNNEL_SERVER_ADDR"); val != "" {
 		return val
 	}
@@ -0,0 +1,131 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, data string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+const baseConfig = `
+deviceName: my-device
+tls:
+  ca: /etc/tessad/ca.crt
+  key: /etc/tessad/device.key
+  cert: /etc/tessad/device.crt
+`
+
+func TestLoadConfigTunnelDefaults(t *testing.T) {
+	conf, err := LoadConfig(writeConfig(t, baseConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tunnel := conf.TunnelConfig
+	if tunnel.ServerAddr != defaultTunnelAddr || tunnel.ServerPort != defaultTunnelPort || tunnel.Protocol != defaultTunnelProtocol {
+		t.Errorf("got server %s:%d over %s, want the defaults", tunnel.ServerAddr, tunnel.ServerPort, tunnel.Protocol)
+	}
+
+	if tunnel.TLSCaFile != "/etc/tessad/ca.crt" || tunnel.TLSKeyFile != "/etc/tessad/device.key" || tunnel.TLSCertFile != "/etc/tessad/device.crt" {
+		t.Errorf("tunnel TLS files not taken from the tls section: %+v", tunnel)
+	}
+}
+
+func TestLoadConfigTunnelSection(t *testing.T) {
+	conf, err := LoadConfig(writeConfig(t, baseConfig+`
+tunnel:
+  serverAddr: staging.example.com
+  serverPort: 7443
+  protocol: wss
+  tlsServerName: frps.example.com
+  poolCount: 5
+  heartbeatInterval: 30s
+  heartbeatTimeout: 90s
+  loginTimeout: 15s
+  proxyURL: http://proxy:3128
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := TunnelConfig{
+		ServerAddr:        "staging.example.com",
+		ServerPort:        7443,
+		Protocol:          "wss",
+		TLSServerName:     "frps.example.com",
+		PoolCount:         5,
+		HeartbeatInterval: 30 * time.Second,
+		HeartbeatTimeout:  90 * time.Second,
+		LoginTimeout:      15 * time.Second,
+		ProxyURL:          "http://proxy:3128",
+		TLSCaFile:         "/etc/tessad/ca.crt",
+		TLSKeyFile:        "/etc/tessad/device.key",
+		TLSCertFile:       "/etc/tessad/device.crt",
+	}
+	if *conf.TunnelConfig != want {
+		t.Errorf("got %+v, want %+v", *conf.TunnelConfig, want)
+	}
+}
+
+func TestLoadConfigTunnelEnv(t *testing.T) {
+	t.Setenv("TESSA_TUNNEL_SERVER_ADDR", "env.example.com")
+	t.Setenv("TESSA_TUNNEL_SERVER_PORT", "7001")
+	t.Setenv("TESSA_TUNNEL_PROTOCOL", "kcp")
+	t.Setenv("TESSA_TUNNEL_LOGIN_TIMEOUT", "1m")
+
+	conf, err := LoadConfig(writeConfig(t, baseConfig+`
+tunnel:
+  serverAddr: staging.example.com
+  poolCount: 2
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tunnel := conf.TunnelConfig
+	if tunnel.ServerAddr != "env.example.com" || tunnel.ServerPort != 7001 || tunnel.Protocol != "kcp" || tunnel.LoginTimeout != time.Minute {
+		t.Errorf("environment did not override the file: %+v", tunnel)
+	}
+	if tunnel.PoolCount != 2 {
+		t.Errorf("pool count = %d, want the file value 2", tunnel.PoolCount)
+	}
+	if conf.TunnelAddr() != "env.example.com" {
+		t.Errorf("TunnelAddr() = %q", conf.TunnelAddr())
+	}
+}
+
+func TestLoadConfigTunnelInvalid(t *testing.T) {
+	tests := map[string]struct {
+		yaml string
+		env  map[string]string
+	}{
+		"protocol":     {yaml: "tunnel:\n  protocol: http\n"},
+		"port":         {yaml: "tunnel:\n  serverPort: 70000\n"},
+		"pool count":   {yaml: "tunnel:\n  poolCount: -1\n"},
+		"env port":     {env: map[string]string{"TESSA_TUNNEL_SERVER_PORT": "seven"}},
+		"env duration": {env: map[string]string{"TESSA_TUNNEL_HEARTBEAT_TIMEOUT": "90"}},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			if _, err := LoadConfig(writeConfig(t, baseConfig+tt.yaml)); err == nil {
+				t.Error("invalid tunnel config accepted")
+			}
+		})
+	}
+}
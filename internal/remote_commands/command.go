@@ -4,27 +4,185 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"math"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/Fyve-Labs/tessa-daemon/internal/remote_commands/handler"
+	"github.com/Fyve-Labs/tessa-daemon/internal/tunnel"
+	"github.com/pkg/errors"
 )
 
 const (
 	StartSSHCommand          = "start-ssh"
 	EnableBeszelAgentCommand = "enable-beszel"
+	StopCommand              = "stop"
+	ExecCommand              = "exec"
+	ExposeCommand            = "expose"
 )
 
+const (
+	// DefaultSSHLifetime bounds remote SSH access when the request sets no expiry.
+	DefaultSSHLifetime = 12 * time.Hour
+	// MaxSSHLifetime is the longest remote SSH access a request can ask for.
+	MaxSSHLifetime = 12 * time.Hour
+
+	// expiryWarning is how long before expiry open sessions are warned.
+	expiryWarning = 5 * time.Minute
+	// shutdownGracePeriod is how long open sessions get to wrap up once the command expired or
+	// was stopped.
+	shutdownGracePeriod = 3 * time.Second
+)
+
+// instanceIDPattern keeps instance IDs usable in tunnel proxy names and domains.
+var instanceIDPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
 type CommandRequest struct {
-	Command string      `json:"command"`
-	Payload interface{} `json:"payload,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	// ID identifies the command instance, several instances of a command can run side by side.
+	// Defaults to the command name.
+	ID        string      `json:"id,omitempty"`
+	Command   string      `json:"command"`
+	Payload   interface{} `json:"payload,omitempty"`
+	TTL       int64       `json:"ttl,omitempty"` // Lifetime in seconds
+	ExpiresAt *time.Time  `json:"expires_at,omitempty"`
+	// Tunnel publishes the command's port as a secret tunnel instead of on the device domain.
+	Tunnel *TunnelRequest `json:"tunnel,omitempty"`
+}
+
+// TunnelRequest asks for an stcp or xtcp proxy, which only frp visitors with the secret key
+// returned in the start result can connect to.
+type TunnelRequest struct {
+	// Type is stcp, or xtcp for visitors to try a peer-to-peer connection first.
+	Type string `json:"type"`
+	// AllowUsers lists the frp users whose visitors may connect, "*" allows every user and empty
+	// only the device's own frp user.
+	AllowUsers []string `json:"allow_users,omitempty"`
+}
+
+func (r *TunnelRequest) Validate() error {
+	if r.Type != tunnel.SecretSTCP && r.Type != tunnel.SecretXTCP {
+		return fmt.Errorf("invalid tunnel type %q, must be stcp or xtcp", r.Type)
+	}
+
+	return nil
+}
+
+// Expiry returns when the requested command must be stopped, or the zero time if it may run forever.
+// defaultTTL applies when the request sets no expiry, maxTTL (if set) bounds the lifetime: larger
+// TTLs are rejected and later expires_at values are clamped.
+func (req *CommandRequest) Expiry(now time.Time, defaultTTL, maxTTL time.Duration) (time.Time, error) {
+	if req.TTL < 0 || req.TTL > math.MaxInt64/int64(time.Second) {
+		return time.Time{}, fmt.Errorf("invalid ttl: %d", req.TTL)
+	}
+
+	if maxTTL > 0 && time.Duration(req.TTL)*time.Second > maxTTL {
+		return time.Time{}, fmt.Errorf("ttl exceeds the maximum of %s", maxTTL)
+	}
+
+	var expiresAt time.Time
+	if req.ExpiresAt != nil {
+		if !req.ExpiresAt.After(now) {
+			return time.Time{}, fmt.Errorf("expires_at is in the past: %s", req.ExpiresAt.Format(time.RFC3339))
+		}
+		expiresAt = *req.ExpiresAt
+	}
+
+	if req.TTL > 0 {
+		ttlExpiry := now.Add(time.Duration(req.TTL) * time.Second)
+		if expiresAt.IsZero() || ttlExpiry.Before(expiresAt) {
+			expiresAt = ttlExpiry
+		}
+	}
+
+	if expiresAt.IsZero() && defaultTTL > 0 {
+		expiresAt = now.Add(defaultTTL)
+	}
+
+	if maxTTL > 0 && (expiresAt.IsZero() || expiresAt.After(now.Add(maxTTL))) {
+		expiresAt = now.Add(maxTTL)
+	}
+
+	return expiresAt, nil
+}
+
+// StopRequest is the payload of the stop command. ID selects the instance to stop,
+// Command alone stops the instance named after the command.
+type StopRequest struct {
+	ID      string `json:"id,omitempty"`
+	Command string `json:"command,omitempty"`
+}
+
+func (r *StopRequest) Validate() error {
+	if r.ID == "" && r.Command == "" {
+		return errors.New("id or command is required")
+	}
+
+	return nil
+}
+
+// InstanceID returns the ID of the command instance to stop.
+func (r *StopRequest) InstanceID() string {
+	if r.ID != "" {
+		return r.ID
+	}
+
+	return r.Command
+}
+
+type StopOutput struct {
+	ID      string `json:"id"`
+	Command string `json:"command"`
 }
 
 type Command struct {
-	ID      string
-	Payload interface{}
-	manager *CommandManager
-	handler handler.Handler
-	ctx     context.Context    // Context for stopping the updater
-	cancel  context.CancelFunc // Stops and removes command from updater
+	ID              string // Instance ID
+	Name            string // Command name in the registry
+	RequestID       string
+	Payload         interface{}
+	StartedAt       time.Time
+	ExpiresAt       time.Time // Zero if the command never expires
+	manager         *CommandManager
+	handler         handler.Handler
+	proxyPort       int                // Local port published through the tunnel, 0 if none
+	proxyDomain     string             // Tunnel domain the local port is reachable at
+	proxyRemotePort int                // Tunnel server port of plain TCP proxies
+	tunnel          *TunnelRequest     // Secret tunnel settings, nil to publish on the device domain
+	secretKey       string             // Visitor key of the secret tunnel
+	persistent      bool               // Restored after a daemon restart
+	job             bool               // Runs to completion, answered accepted before it starts
+	ctx             context.Context    // Context for stopping the updater
+	cancel          context.CancelFunc // Stops and removes command from updater
+	stopOnce        sync.Once
+	started         atomic.Bool  // Set once Start has built the handler and published its tunnel
+	stopping        atomic.Bool  // Set once a stop request is being carried out
+	outputSeq       atomic.Int64 // Sequence number of the last streamed output chunk
+}
+
+// CommandState is the lifecycle state of an active command instance.
+type CommandState string
+
+const (
+	StateStarting CommandState = "starting"
+	StateRunning  CommandState = "running"
+	StateStopping CommandState = "stopping"
+)
+
+// CommandInfo describes an active command instance in list responses.
+type CommandInfo struct {
+	ID        string        `json:"id"`
+	Command   string        `json:"command"`
+	RequestID string        `json:"request_id"`
+	State     CommandState  `json:"state"`
+	StartedAt *time.Time    `json:"started_at,omitempty"`
+	ExpiresAt *time.Time    `json:"expires_at,omitempty"`
+	Tunnel    *TunnelOutput `json:"tunnel,omitempty"`
+	Output    interface{}   `json:"output,omitempty"`
 }
 
 func (cmd *Command) getContext() (context.Context, context.CancelFunc) {
@@ -35,13 +193,116 @@ func (cmd *Command) getContext() (context.Context, context.CancelFunc) {
 	return cmd.ctx, cmd.cancel
 }
 
-func (cmd *Command) Start() {
+// Start builds the command handler from the registry and keeps it running in the background.
+func (cmd *Command) Start() error {
 	if cmd.handler != nil {
-		return
+		return nil
+	}
+
+	def, err := Lookup(cmd.Name)
+	if err != nil {
+		return err
+	}
+
+	h, err := def.newHandler(cmd)
+	if err != nil {
+		return err
+	}
+	cmd.handler = h
+
+	if p, ok := h.(handler.Proxied); ok && p.ListenPort() > 0 {
+		if err = cmd.publishPort(h, p.ListenPort()); err != nil {
+			cmd.discard(h)
+			return err
+		}
+	} else if cmd.tunnel != nil {
+		cmd.discard(h)
+		return fmt.Errorf("%w: %s has no port for a secret tunnel", ErrInvalidPayload, cmd.Name)
+	}
+
+	if cmd.StartedAt.IsZero() {
+		cmd.StartedAt = time.Now().UTC()
+	}
+	cmd.started.Store(true)
+	go cmd.run()
+
+	return nil
+}
+
+// publishPort publishes the handler's local port through the tunnel, as a secret proxy when the
+// request asked for one.
+func (cmd *Command) publishPort(h handler.Handler, port int) error {
+	tm := cmd.manager.tunnelManager
+	pp, ok := h.(handler.ProxyProtocolAware)
+	proxyProtocol := ok && pp.ProxyProtocol()
+
+	var err error
+	cmd.proxyPort = port
+	if cmd.tunnel != nil {
+		cmd.proxyDomain, err = tm.ProxySecret(cmd.proxyName(), "127.0.0.1", port, proxyProtocol, &tunnel.SecretProxy{
+			Type:       cmd.tunnel.Type,
+			SecretKey:  cmd.secretKey,
+			AllowUsers: cmd.tunnel.AllowUsers,
+		})
+	} else if t, ok := h.(handler.TCPProxied); ok && t.RemotePort() > 0 {
+		cmd.proxyRemotePort = t.RemotePort()
+		cmd.proxyDomain, err = tm.ProxyTCP(cmd.proxyName(), "127.0.0.1", port, cmd.proxyRemotePort)
+	} else {
+		cmd.proxyDomain, err = tm.Proxy(cmd.proxyName(), "127.0.0.1", port, proxyProtocol)
+	}
+	if err != nil {
+		return err
+	}
+
+	if e, ok := h.(handler.Exposed); ok {
+		endpoint := cmd.proxyDomain
+		if cmd.proxyRemotePort != 0 {
+			endpoint = net.JoinHostPort(cmd.proxyDomain, strconv.Itoa(cmd.proxyRemotePort))
+		}
+		e.SetTunnelEndpoint(endpoint)
+	}
+
+	return nil
+}
+
+// discard stops a handler the command failed to start with. Its port was not published, so
+// nothing is left for Stop to tear down.
+func (cmd *Command) discard(h handler.Handler) {
+	cmd.handler, cmd.proxyPort, cmd.proxyDomain, cmd.proxyRemotePort = nil, 0, "", 0
+	if err := h.Stop(); err != nil {
+		slog.Error(fmt.Sprintf("Failed to stop command hanler: %v", err), slog.String("id", cmd.ID))
 	}
+}
+
+// proxyName is the tunnel proxy suffix of the command instance. The default SSH instance
+// keeps the bare device name, other instances are suffixed with their ID.
+func (cmd *Command) proxyName() string {
+	name := strings.TrimPrefix(cmd.Name, "enable-")
+	if cmd.Name == StartSSHCommand {
+		name = ""
+	}
+
+	if cmd.ID != cmd.Name {
+		name = strings.Trim(name+"-"+cmd.ID, "-")
+	}
+
+	return name
+}
+
+func (cmd *Command) run() {
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.handler.Handle(cmd.ctx)
+	}()
 
-	if cmd.ID == StartSSHCommand {
-		cmd.startSSHServer()
+	var warnC, expireC <-chan time.Time
+	if !cmd.ExpiresAt.IsZero() {
+		warnTimer := time.NewTimer(time.Until(cmd.ExpiresAt.Add(-expiryWarning)))
+		defer warnTimer.Stop()
+		expireTimer := time.NewTimer(time.Until(cmd.ExpiresAt))
+		defer expireTimer.Stop()
+
+		warnC, expireC = warnTimer.C, expireTimer.C
 	}
 
 	for {
@@ -49,42 +310,155 @@ func (cmd *Command) Start() {
 		case <-cmd.ctx.Done():
 			cmd.Stop()
 			return
+		case <-warnC:
+			warnC = nil
+			remaining := time.Until(cmd.ExpiresAt).Round(time.Second)
+			cmd.notify(fmt.Sprintf("!!! Remote access expires in %s !!!", remaining))
+		case <-expireC:
+			cmd.expire()
+			return
+		case err := <-done:
+			if cmd.ctx.Err() != nil {
+				// Stopped on request, the outcome is reported by the caller
+				return
+			}
+
+			// The handler exited on its own, report the outcome and drop the command
+			cmd.manager.forget(cmd.ID)
+			cmd.Stop()
+
+			if err != nil {
+				slog.Error(fmt.Sprintf("command handler: %v", err), slog.String("id", cmd.ID))
+				cmd.manager.publishResult(cmd.result(StatusFailed, err))
+				return
+			}
+
+			cmd.manager.publishResult(cmd.result(StatusSucceeded, nil))
+			return
 		}
 	}
 }
 
-func (cmd *Command) startSSHServer() {
-	if cmd.handler != nil {
+// expire warns the handler's users, stops the command and publishes the expiry event.
+func (cmd *Command) expire() {
+	slog.Info("Command expired. Beginning graceful shutdown...", slog.String("id", cmd.ID))
+	if !cmd.announceShutdown("Remote access expired.") {
+		// stopped during the grace period
 		return
 	}
 
-	h, err := handler.NewSSHServerHandler(cmd.Payload)
-	if err != nil {
-		slog.Error(fmt.Sprintf("new SSH server: %v", err), slog.String("command", cmd.ID))
-		return
+	cmd.manager.forget(cmd.ID)
+	err := cmd.Stop()
+	cmd.manager.publishResult(cmd.result(StatusExpired, err))
+}
+
+// announceShutdown warns the open sessions of the handler and gives them shutdownGracePeriod to
+// wrap up. It returns false if the command was stopped in the meantime.
+func (cmd *Command) announceShutdown(reason string) bool {
+	if t, ok := cmd.handler.(handler.SessionTracker); !ok || len(t.Sessions()) == 0 {
+		return cmd.ctx.Err() == nil
 	}
-	cmd.handler = h
 
-	go func() {
-		if err := cmd.handler.Handle(cmd.ctx); err != nil {
-			slog.Error(fmt.Sprintf("start ssh server: %v", err), slog.String("command", cmd.ID))
-		}
-	}()
+	cmd.notify(fmt.Sprintf("!!! %s Shutting down in %s !!!", reason, shutdownGracePeriod))
+
+	select {
+	case <-cmd.ctx.Done():
+		return false
+	case <-time.After(shutdownGracePeriod):
+		return true
+	}
+}
 
-	cmd.manager.tunnelManager.ProxySSH("127.0.0.1", h.ListenPort())
+// notify broadcasts a message to the handler's users if it supports it.
+func (cmd *Command) notify(message string) {
+	if n, ok := cmd.handler.(handler.Notifier); ok {
+		n.Notify(message)
+	}
 }
 
-func (cmd *Command) Stop() {
+// result builds a result envelope for this command, including handler output.
+func (cmd *Command) result(status CommandStatus, err error) *CommandResult {
+	result := newCommandResult(cmd.RequestID, cmd.Name, status, err)
+	result.ID = cmd.ID
+	result.Tunnel = cmd.tunnelOutput()
+
+	if !cmd.ExpiresAt.IsZero() {
+		result.ExpiresAt = &cmd.ExpiresAt
+	}
+
 	if cmd.handler != nil {
-		if err := cmd.handler.Stop(); err != nil {
-			slog.Error(fmt.Sprintf("Failed to stop command hanler: %v", err), slog.String("command", cmd.ID))
+		result.Output = cmd.handler.Output()
+	}
+
+	return result
+}
+
+// tunnelOutput tells where the command's port is published, or nil. The secret key is left out,
+// only the start result carries it.
+func (cmd *Command) tunnelOutput() *TunnelOutput {
+	if cmd.proxyDomain == "" {
+		return nil
+	}
+
+	output := &TunnelOutput{
+		Domain:     cmd.proxyDomain,
+		RemotePort: cmd.proxyRemotePort,
+		LocalPort:  cmd.proxyPort,
+		Status:     cmd.tunnelStatus(),
+	}
+	if cmd.tunnel != nil {
+		output.Type = cmd.tunnel.Type
+	}
+
+	return output
+}
+
+// Info returns a snapshot of the command instance for list responses.
+func (cmd *Command) Info() *CommandInfo {
+	info := &CommandInfo{
+		ID:        cmd.ID,
+		Command:   cmd.Name,
+		RequestID: cmd.RequestID,
+		State:     StateStarting,
+	}
+	if !cmd.ExpiresAt.IsZero() {
+		info.ExpiresAt = &cmd.ExpiresAt
+	}
+
+	// Handler and tunnel fields are only safe to read once Start is done with them
+	if !cmd.started.Load() {
+		return info
+	}
+
+	info.State = StateRunning
+	if cmd.stopping.Load() || cmd.ctx.Err() != nil {
+		info.State = StateStopping
+	}
+
+	info.StartedAt = &cmd.StartedAt
+	info.Tunnel = cmd.tunnelOutput()
+	info.Output = cmd.handler.Output()
+
+	return info
+}
+
+// Stop cancels the command context, stops its handler and tears down its tunnel proxy.
+// It is safe to call more than once, only the first call has an effect.
+func (cmd *Command) Stop() error {
+	var err error
+	cmd.stopOnce.Do(func() {
+		cmd.cancel()
+
+		if cmd.handler != nil {
+			if err = cmd.handler.Stop(); err != nil {
+				slog.Error(fmt.Sprintf("Failed to stop command hanler: %v", err), slog.String("id", cmd.ID))
+			}
 		}
 
-		if h, ok := cmd.handler.(*handler.SSHServerHandler); ok {
-			cmd.manager.tunnelManager.UnProxy("127.0.0.1", h.ListenPort())
+		if cmd.proxyPort != 0 {
+			cmd.manager.tunnelManager.UnProxy("127.0.0.1", cmd.proxyPort)
 		}
-	}
+	})
 
-	cmd.handler = nil
-	cmd.cancel()
+	return err
 }
@@ -5,121 +5,436 @@ import (
 	"fmt"
 	"log"
 	"log/slog"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/Fyve-Labs/tessa-daemon/internal/config"
+	"github.com/Fyve-Labs/tessa-daemon/internal/remote_commands/handler"
 	"github.com/Fyve-Labs/tessa-daemon/internal/tunnel"
 	"github.com/nats-io/nats.go"
 	"github.com/pkg/errors"
+	"github.com/pocketbase/pocketbase/tools/security"
 	"github.com/pocketbase/pocketbase/tools/store"
 )
 
-const NatsCommandsSubject = "tessa.devices.%s.commands.json"
+const (
+	NatsCommandsSubject = "tessa.devices.%s.commands.json"
+	// NatsListSubject answers requests with the active command instances of the device.
+	NatsListSubject = "tessa.devices.%s.commands.list"
+)
+
+var (
+	ErrCommandAlreadyRunning = errors.New("command is already running")
+	ErrCommandNotFound       = errors.New("command not found")
+)
+
+// CommandList is the reply to a list request.
+type CommandList struct {
+	Commands []*CommandInfo `json:"commands"`
+	Time     time.Time      `json:"time"`
+}
 
 type CommandManager struct {
+	config        *config.Config
 	natsConn      *nats.Conn
+	publish       func(subject string, data []byte) error // Sends replies and results, natsConn.Publish
 	tunnelManager *tunnel.Manager
 	subscriptions []*nats.Subscription
 	commands      *store.Store[string, *Command] // Thread-safe store of active commands
+	persistMu     sync.Mutex                     // Serializes writes of the persisted commands
+	revocations   *handler.RevocationList        // Device revocation list shared by SSH servers
+	hostKey       *handler.HostKey               // Device SSH host key, nil until Initialize
 }
 
-func NewCommandManager(natsConn *nats.Conn, tunnelManager *tunnel.Manager) *CommandManager {
+func NewCommandManager(conf *config.Config, natsConn *nats.Conn, tunnelManager *tunnel.Manager) *CommandManager {
 	return &CommandManager{
+		config:        conf,
 		commands:      store.New(map[string]*Command{}),
 		subscriptions: make([]*nats.Subscription, 0),
 		natsConn:      natsConn,
+		publish:       natsConn.Publish,
 		tunnelManager: tunnelManager,
+		revocations:   &handler.RevocationList{},
 	}
 }
 
-// GetCommand returns a system by ID from the store
-func (cm *CommandManager) GetCommand(commandID string) (*Command, error) {
-	cmd, ok := cm.commands.GetOk(commandID)
+// GetCommand returns a command instance by ID from the store
+func (cm *CommandManager) GetCommand(id string) (*Command, error) {
+	cmd, ok := cm.commands.GetOk(id)
 	if !ok {
-		return nil, fmt.Errorf("command not found")
+		return nil, ErrCommandNotFound
 	}
 	return cmd, nil
 }
 
+// Commands returns every active command instance.
+func (cm *CommandManager) Commands() []*Command {
+	return cm.commands.Values()
+}
+
 func (cm *CommandManager) Initialize() error {
+	if cm.tunnelManager != nil {
+		cm.tunnelManager.OnStatusChange(cm.publishTunnelStatus)
+	}
+
+	// Revocations and the host key apply to restored SSH servers too
+	cm.loadRevocations()
+	cm.loadHostKey()
+
+	// Restart commands that were active before the daemon stopped
+	cm.restoreCommands()
+
 	// start nat subscription
 	if err := cm.startSubscriptions(); err != nil {
 		return err
 	}
 
-	// Load commands from config
-	//_ = cm.AddCommand(&Command{
-	//	ID: "start-ssh",
-	//})
+	// Load commands from config, they are started from config again after a restart.
+	// The config file wins over a restored instance with the same ID.
+	for _, c := range cm.config.Commands {
+		cmd, err := cm.newCommand(&CommandRequest{
+			RequestID: security.RandomString(16),
+			Command:   c.Command,
+			Payload:   c.Payload,
+		})
+		if err == nil {
+			if cm.commands.Has(cmd.ID) {
+				slog.Info("Replacing restored command with the config file entry", slog.String("id", cmd.ID))
+				if err := cm.RemoveCommand(cmd.ID); err != nil {
+					slog.Warn(fmt.Sprintf("stop restored command: %v", err), slog.String("id", cmd.ID))
+				}
+			}
 
-	_ = cm.AddCommand(&Command{
-		ID: "enable-beszel",
-		Payload: &BeszelConfig{
-			ServerURL:    "http://192.168.1.100:8090",
-			Token:        "",
-			SSHPublicKey: "",
-		},
-	})
+			cmd.persistent = false
+			err = cm.AddCommand(cmd)
+		}
+
+		if err != nil {
+			slog.Warn(fmt.Sprintf("add command from config: %v", err), slog.String("command", c.Command))
+		}
+	}
 
 	return nil
 }
 
+// newCommand builds a command from a request, resolving its expiry from the registry defaults.
+func (cm *CommandManager) newCommand(req *CommandRequest) (*Command, error) {
+	def, err := Lookup(req.Command)
+	if err != nil {
+		return nil, err
+	}
+
+	expiresAt, err := req.Expiry(time.Now().UTC(), def.DefaultTTL, def.MaxTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	id := req.ID
+	if id == "" {
+		id = req.Command
+	}
+
+	if !instanceIDPattern.MatchString(id) {
+		return nil, fmt.Errorf("invalid id %q: expected lowercase letters, digits and dashes", id)
+	}
+
+	// Invalid payloads are rejected before anything is answered or started
+	if err = def.validate(req.Payload); err != nil {
+		return nil, err
+	}
+
+	cmd := &Command{
+		ID:         id,
+		Name:       req.Command,
+		RequestID:  req.RequestID,
+		Payload:    req.Payload,
+		ExpiresAt:  expiresAt,
+		persistent: def.Persistent,
+		job:        def.Job,
+	}
+
+	if req.Tunnel != nil {
+		if err = req.Tunnel.Validate(); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+		}
+
+		// Every instance gets its own key, so it only lets in the requester's visitor
+		cmd.tunnel, cmd.secretKey = req.Tunnel, security.RandomString(32)
+	}
+
+	return cmd, nil
+}
+
 func (cm *CommandManager) AddCommand(cmd *Command) error {
 	if cm.commands.Has(cmd.ID) {
-		slog.Info("command is already running", slog.String("command", cmd.ID))
-		return nil
+		slog.Info("command is already running", slog.String("command", cmd.Name), slog.String("id", cmd.ID))
+		return ErrCommandAlreadyRunning
 	}
 
 	cmd.manager = cm
 	cmd.ctx, cmd.cancel = cmd.getContext()
 	cm.commands.Set(cmd.ID, cmd)
 
-	go cmd.Start()
+	if err := cmd.Start(); err != nil {
+		cm.commands.Remove(cmd.ID)
+		cmd.cancel()
+		return err
+	}
+
+	if cmd.persistent {
+		cm.saveCommands()
+	}
 
 	return nil
 }
 
-func (cm *CommandManager) RemoveCommand(commandID string) error {
-	command, ok := cm.commands.GetOk(commandID)
+// RemoveCommand stops a running command instance and waits for its handler and tunnel proxy to be torn down.
+func (cm *CommandManager) RemoveCommand(id string) error {
+	command, ok := cm.commands.GetOk(id)
 	if !ok {
-		return errors.New("command not found")
+		return ErrCommandNotFound
 	}
 
-	// Stop the update goroutine
-	if command.cancel != nil {
-		command.cancel()
+	cm.forget(id)
+	return command.Stop()
+}
+
+// forget drops a command instance from the store and from the persisted commands, so it is not
+// restored after a restart.
+func (cm *CommandManager) forget(id string) {
+	cmd, ok := cm.commands.GetOk(id)
+	if !ok {
+		return
 	}
 
-	cm.commands.Remove(commandID)
-	return nil
+	cm.commands.Remove(id)
+	if cmd.persistent {
+		cm.saveCommands()
+	}
 }
 
 func (cm *CommandManager) startSubscriptions() error {
-	sub, err := cm.natsConn.Subscribe(fmt.Sprintf(NatsCommandsSubject, config.DeviceName), func(m *nats.Msg) {
+	handlers := map[string]nats.MsgHandler{
+		NatsCommandsSubject:     cm.handleCommandRequest,
+		NatsListSubject:         cm.handleListRequest,
+		NatsRevocationsSubject:  cm.handleRevocationUpdate,
+		NatsHostKeySubject:      cm.handleHostKeyRequest,
+		NatsHostCertSubject:     cm.handleHostCertificate,
+		NatsSessionsSubject:     cm.handleSessionsRequest,
+		NatsSessionsKillSubject: cm.handleKillSessionsRequest,
+	}
 
-		var req CommandRequest
-		if err := json.Unmarshal(m.Data, &req); err != nil {
-			log.Printf("ERROR: Could not unmarshal command request: %v", err)
-			return
+	for subject, handle := range handlers {
+		sub, err := cm.natsConn.Subscribe(fmt.Sprintf(subject, config.DeviceName), handle)
+		if err != nil {
+			return err
 		}
 
-		slog.Info("Received command request", slog.String("command", req.Command))
-		err := cm.AddCommand(&Command{
-			ID:      req.Command,
-			Payload: req.Payload,
-		})
+		cm.subscriptions = append(cm.subscriptions, sub)
+	}
 
-		if err != nil {
-			log.Printf("AddCommand: %v", err)
-		}
+	return nil
+}
+
+func (cm *CommandManager) handleListRequest(m *nats.Msg) {
+	if m.Reply == "" {
+		slog.Warn("Ignoring list request without reply subject")
+		return
+	}
+
+	list := &CommandList{Commands: make([]*CommandInfo, 0), Time: time.Now().UTC()}
+	for _, cmd := range cm.Commands() {
+		list.Commands = append(list.Commands, cmd.Info())
+	}
+
+	sort.Slice(list.Commands, func(i, j int) bool {
+		return list.Commands[i].ID < list.Commands[j].ID
 	})
 
+	data, err := json.Marshal(list)
 	if err != nil {
-		return err
+		slog.Error(fmt.Sprintf("marshal command list: %v", err))
+		return
 	}
 
-	cm.subscriptions = append(cm.subscriptions, sub)
+	if err := m.Respond(data); err != nil {
+		slog.Error(fmt.Sprintf("respond to list request: %v", err))
+	}
+}
 
-	return nil
+func (cm *CommandManager) handleCommandRequest(m *nats.Msg) {
+	var req CommandRequest
+	if err := json.Unmarshal(m.Data, &req); err != nil {
+		log.Printf("ERROR: Could not unmarshal command request: %v", err)
+		cm.respond(m, newCommandResult("", "", StatusRejected, fmt.Errorf("invalid command request: %w", err)))
+		return
+	}
+
+	if req.RequestID == "" {
+		req.RequestID = security.RandomString(16)
+	}
+
+	slog.Info("Received command request", slog.String("command", req.Command), slog.String("id", req.ID), slog.String("request_id", req.RequestID))
+	if req.Command == StopCommand {
+		cm.handleStopRequest(m, &req)
+		return
+	}
+
+	cmd, err := cm.newCommand(&req)
+	if err != nil {
+		result := newCommandResult(req.RequestID, req.Command, StatusRejected, err)
+		result.ID = req.ID
+		cm.respond(m, result)
+		return
+	}
+
+	if cmd.job {
+		cm.startJob(m, cmd)
+		return
+	}
+
+	if err := cm.AddCommand(cmd); err != nil {
+		log.Printf("AddCommand: %v", err)
+		cm.respond(m, startErrorResult(cmd, err))
+		return
+	}
+
+	// Report whether the tunnel publishes the command, rather than leave the requester to time out.
+	// The wait runs aside so it does not hold up the requests queued behind this one.
+	go func() {
+		cmd.waitTunnel(tunnelStartTimeout)
+
+		result := cmd.result(StatusRunning, nil)
+		if result.Tunnel != nil && cmd.secretKey != "" {
+			result.Tunnel.SecretKey = cmd.secretKey
+		}
+
+		cm.respond(m, result)
+	}()
+}
+
+// startJob answers a job accepted once it is queued, before it runs. Its outcome is published on
+// the results subject when it ends, or when it fails to start.
+func (cm *CommandManager) startJob(m *nats.Msg, cmd *Command) {
+	if cm.commands.Has(cmd.ID) {
+		cm.respond(m, startErrorResult(cmd, ErrCommandAlreadyRunning))
+		return
+	}
+
+	cm.respond(m, cmd.result(StatusAccepted, nil))
+
+	if err := cm.AddCommand(cmd); err != nil {
+		slog.Error(fmt.Sprintf("start job: %v", err), slog.String("id", cmd.ID))
+		cm.publishResult(startErrorResult(cmd, err))
+	}
+}
+
+// startErrorResult reports a command that failed to start: rejected when the request is at fault,
+// failed otherwise.
+func startErrorResult(cmd *Command, err error) *CommandResult {
+	status := StatusFailed
+	if errors.Is(err, ErrCommandAlreadyRunning) || errors.Is(err, ErrInvalidPayload) || errors.Is(err, tunnel.ErrProxyNameInUse) {
+		status = StatusRejected
+	}
+
+	result := newCommandResult(cmd.RequestID, cmd.Name, status, err)
+	result.ID = cmd.ID
+
+	return result
+}
+
+func (cm *CommandManager) handleStopRequest(m *nats.Msg, req *CommandRequest) {
+	stopReq, err := handler.JsonPayloadToConfig[StopRequest](req.Payload)
+	if err != nil {
+		cm.respond(m, newCommandResult(req.RequestID, req.Command, StatusRejected, fmt.Errorf("%w: %v", ErrInvalidPayload, err)))
+		return
+	}
+
+	cmd, err := cm.GetCommand(stopReq.InstanceID())
+	if err != nil {
+		cm.respond(m, newCommandResult(req.RequestID, req.Command, StatusRejected, err))
+		return
+	}
+
+	result := newCommandResult(req.RequestID, req.Command, StatusSucceeded, nil)
+	result.Output = &StopOutput{ID: cmd.ID, Command: cmd.Name}
+	cm.respond(m, result)
+
+	// The grace period and teardown run aside, a repeated stop is answered without starting another
+	if cmd.stopping.CompareAndSwap(false, true) {
+		go cm.stopCommand(cmd, req.RequestID)
+	}
+}
+
+// stopCommand gives the command's sessions the shutdown grace period, removes it and publishes
+// the stopped result.
+func (cm *CommandManager) stopCommand(cmd *Command, requestID string) {
+	if cmd.started.Load() {
+		cmd.announceShutdown("Remote access was stopped.")
+	}
+
+	err := cm.RemoveCommand(cmd.ID)
+	if errors.Is(err, ErrCommandNotFound) {
+		// It ended on its own during the grace period, and reported it
+		return
+	}
+
+	slog.Info("Stopped command", slog.String("command", cmd.Name), slog.String("id", cmd.ID), slog.String("request_id", requestID))
+	cm.publishResult(cmd.result(StatusStopped, err))
+}
+
+// respond answers a command request on its reply subject, falling back to the results subject.
+func (cm *CommandManager) respond(m *nats.Msg, result *CommandResult) {
+	if m.Reply == "" {
+		cm.publishResult(result)
+		return
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		slog.Error(fmt.Sprintf("marshal command result: %v", err), slog.String("command", result.Command))
+		return
+	}
+
+	if err := cm.publish(m.Reply, data); err != nil {
+		slog.Error(fmt.Sprintf("respond to command request: %v", err), slog.String("command", result.Command))
+	}
+}
+
+// publishResult sends a command result to the results subject.
+func (cm *CommandManager) publishResult(result *CommandResult) {
+	data, err := json.Marshal(result)
+	if err != nil {
+		slog.Error(fmt.Sprintf("marshal command result: %v", err), slog.String("command", result.Command))
+		return
+	}
+
+	if err := cm.publish(fmt.Sprintf(NatsResultsSubject, config.DeviceName), data); err != nil {
+		slog.Error(fmt.Sprintf("publish command result: %v", err), slog.String("command", result.Command))
+	}
+}
+
+// publishOutput streams a chunk of a command's output on its output subject.
+func (cm *CommandManager) publishOutput(cmd *Command, stream string, data []byte) {
+	chunk := &OutputChunk{
+		RequestID: cmd.RequestID,
+		ID:        cmd.ID,
+		Stream:    stream,
+		Seq:       cmd.outputSeq.Add(1),
+		Data:      string(data),
+		Time:      time.Now().UTC(),
+	}
+
+	msg, err := json.Marshal(chunk)
+	if err != nil {
+		slog.Error(fmt.Sprintf("marshal command output: %v", err), slog.String("id", cmd.ID))
+		return
+	}
+
+	if err := cm.publish(fmt.Sprintf(NatsOutputSubject, config.DeviceName, cmd.ID), msg); err != nil {
+		slog.Error(fmt.Sprintf("publish command output: %v", err), slog.String("id", cmd.ID))
+	}
 }
 
 func (cm *CommandManager) Stop() error {
@@ -129,9 +444,11 @@ func (cm *CommandManager) Stop() error {
 		}
 	}
 
+	// Persisted commands are kept on disk, they are restored on the next start
 	for _, cmd := range cm.commands.GetAll() {
-		if err := cm.RemoveCommand(cmd.ID); err != nil {
-			return err
+		cm.commands.Remove(cmd.ID)
+		if err := cmd.Stop(); err != nil {
+			slog.Error(fmt.Sprintf("stop command: %v", err), slog.String("id", cmd.ID))
 		}
 	}
 
@@ -0,0 +1,522 @@
+package remote_commands
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Fyve-Labs/tessa-daemon/internal/config"
+	"github.com/Fyve-Labs/tessa-daemon/internal/remote_commands/handler"
+	"github.com/Fyve-Labs/tessa-daemon/internal/tunnel"
+	"github.com/nats-io/nats.go"
+	"github.com/pocketbase/pocketbase/tools/store"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const (
+	testJobCommand     = "test-job"
+	testProxiedCommand = "test-proxied"
+	testSessionCommand = "test-session"
+	testReply          = "_INBOX.test"
+	// testProxiedAlias gets the same default proxy name as testProxiedCommand
+	testProxiedAlias = "enable-test-proxied"
+)
+
+// testJobHandler ends as soon as it runs.
+type testJobHandler struct{}
+
+func (h *testJobHandler) Handle(context.Context) error { return nil }
+
+func (h *testJobHandler) Stop() error { return nil }
+
+func (h *testJobHandler) Output() interface{} { return nil }
+
+// testProxiedHandler serves a port through the tunnel and records how it was stopped.
+type testProxiedHandler struct {
+	port    int
+	stopped atomic.Bool
+	done    chan struct{} // Closed once Handle saw its context cancelled
+}
+
+func (h *testProxiedHandler) Handle(ctx context.Context) error {
+	<-ctx.Done()
+	close(h.done)
+	return nil
+}
+
+func (h *testProxiedHandler) Stop() error {
+	h.stopped.Store(true)
+	return nil
+}
+
+func (h *testProxiedHandler) Output() interface{} { return nil }
+
+func (h *testProxiedHandler) ListenPort() int { return h.port }
+
+// testProxiedHandlers keeps the handlers built for testProxiedCommand by instance ID.
+var testProxiedHandlers = store.New(map[string]*testProxiedHandler{})
+
+// testSessionHandler has a session open, so stopping it waits the shutdown grace period.
+type testSessionHandler struct {
+	testHandler
+}
+
+func (h *testSessionHandler) Sessions() []*handler.SSHSessionOutput {
+	return []*handler.SSHSessionOutput{{ID: "session"}}
+}
+
+func (h *testSessionHandler) Disconnect(handler.SSHSessionFilter, string, time.Duration) int {
+	return 0
+}
+
+func init() {
+	Register(Definition{Name: testJobCommand, Job: true}, func(_ *Command, _ *testPayload) (handler.Handler, error) {
+		return &testJobHandler{}, nil
+	})
+
+	var ports atomic.Int64
+	newProxied := func(cmd *Command, _ *testPayload) (handler.Handler, error) {
+		h := &testProxiedHandler{port: 40000 + int(ports.Add(1)), done: make(chan struct{})}
+		testProxiedHandlers.Set(cmd.ID, h)
+		return h, nil
+	}
+	Register(Definition{Name: testProxiedCommand, Persistent: true}, newProxied)
+	Register(Definition{Name: testProxiedAlias}, newProxied)
+
+	Register(Definition{Name: testSessionCommand}, func(_ *Command, _ *testPayload) (handler.Handler, error) {
+		return &testSessionHandler{}, nil
+	})
+}
+
+// newTestTunnel gives cm a tunnel whose server refuses connections.
+func newTestTunnel(t *testing.T, cm *CommandManager) *tunnel.Manager {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	_ = l.Close()
+
+	tm, err := tunnel.NewManager("my-device", &config.TunnelConfig{ServerAddr: "127.0.0.1", ServerPort: port, Protocol: "tcp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(tm.Stop)
+	cm.tunnelManager = tm
+
+	return tm
+}
+
+// publishedMsg is a reply or result the manager sent.
+type publishedMsg struct {
+	subject string
+	data    []byte
+}
+
+// publishedMsgs holds what the manager sent instead of publishing it on NATS.
+type publishedMsgs struct {
+	c       chan publishedMsg
+	pending []publishedMsg // Received while waiting on another subject
+}
+
+func recordPublished(cm *CommandManager) *publishedMsgs {
+	msgs := &publishedMsgs{c: make(chan publishedMsg, 100)}
+	cm.publish = func(subject string, data []byte) error {
+		msgs.c <- publishedMsg{subject: subject, data: data}
+		return nil
+	}
+
+	return msgs
+}
+
+// nextResult returns the next result sent on subject.
+func nextResult(t *testing.T, msgs *publishedMsgs, subject string) *CommandResult {
+	t.Helper()
+
+	decode := func(msg publishedMsg) *CommandResult {
+		var result CommandResult
+		if err := json.Unmarshal(msg.data, &result); err != nil {
+			t.Fatal(err)
+		}
+		return &result
+	}
+
+	for i, msg := range msgs.pending {
+		if msg.subject == subject {
+			msgs.pending = append(msgs.pending[:i], msgs.pending[i+1:]...)
+			return decode(msg)
+		}
+	}
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg := <-msgs.c:
+			if msg.subject == subject {
+				return decode(msg)
+			}
+			msgs.pending = append(msgs.pending, msg)
+		case <-timeout:
+			t.Fatalf("no result on %s", subject)
+			return nil
+		}
+	}
+}
+
+// request sends a command request with a reply subject and returns the reply.
+func request(t *testing.T, cm *CommandManager, msgs *publishedMsgs, req interface{}) *CommandResult {
+	t.Helper()
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cm.handleCommandRequest(&nats.Msg{Reply: testReply, Data: data})
+	return nextResult(t, msgs, testReply)
+}
+
+func resultsSubject() string {
+	return fmt.Sprintf(NatsResultsSubject, config.DeviceName)
+}
+
+func TestCommandRequestEnvelope(t *testing.T) {
+	cm := newTestManager(t, t.TempDir())
+	msgs := recordPublished(cm)
+
+	result := request(t, cm, msgs, &CommandRequest{RequestID: "req-1", Command: testEphemeralCommand, Payload: map[string]interface{}{}})
+	if result.RequestID != "req-1" || result.ID != testEphemeralCommand || result.Command != testEphemeralCommand ||
+		result.Status != StatusRunning || result.Error != "" || result.Time.IsZero() {
+		t.Fatalf("start reply %+v", result)
+	}
+
+	// Requests without an ID get one, so results can still be told apart
+	result = request(t, cm, msgs, &CommandRequest{ID: "two", Command: testEphemeralCommand})
+	if result.RequestID == "" || result.Status != StatusRunning {
+		t.Errorf("reply without request ID %+v", result)
+	}
+
+	cm.handleCommandRequest(&nats.Msg{Reply: testReply, Data: []byte("{not json")})
+	if result = nextResult(t, msgs, testReply); result.Status != StatusRejected || result.Error == "" {
+		t.Errorf("reply to a malformed request %+v", result)
+	}
+
+	// Without a reply subject the result goes to the results subject
+	data, _ := json.Marshal(&CommandRequest{RequestID: "req-3", ID: "three", Command: testEphemeralCommand})
+	cm.handleCommandRequest(&nats.Msg{Data: data})
+	if result = nextResult(t, msgs, resultsSubject()); result.RequestID != "req-3" || result.Status != StatusRunning {
+		t.Errorf("published result %+v", result)
+	}
+}
+
+func TestJobIsAcceptedBeforeItRuns(t *testing.T) {
+	cm := newTestManager(t, t.TempDir())
+	msgs := recordPublished(cm)
+
+	result := request(t, cm, msgs, &CommandRequest{RequestID: "req-1", ID: "job", Command: testJobCommand})
+	if result.Status != StatusAccepted || result.ID != "job" || result.RequestID != "req-1" {
+		t.Fatalf("job reply %+v", result)
+	}
+
+	// The outcome follows on the results subject once the job ends
+	if result = nextResult(t, msgs, resultsSubject()); result.Status != StatusSucceeded || result.ID != "job" || result.RequestID != "req-1" {
+		t.Fatalf("job result %+v", result)
+	}
+
+	result = request(t, cm, msgs, &CommandRequest{ID: "job", Command: testJobCommand, Payload: map[string]interface{}{"unknown": true}})
+	if result.Status != StatusRejected {
+		t.Errorf("job with an invalid payload %+v, want rejected before it is accepted", result)
+	}
+}
+
+func TestCommandInfo(t *testing.T) {
+	cm := newTestManager(t, t.TempDir())
+
+	cmd := &Command{ID: "one", Name: testEphemeralCommand, RequestID: "req-1", Payload: map[string]interface{}{}}
+	if info := cmd.Info(); info.State != StateStarting || info.StartedAt != nil {
+		t.Fatalf("info before start: %+v", info)
+	}
+
+	if err := cm.AddCommand(cmd); err != nil {
+		t.Fatal(err)
+	}
+
+	info := cmd.Info()
+	if info.State != StateRunning || info.StartedAt == nil || info.Command != testEphemeralCommand {
+		t.Fatalf("info after start: %+v", info)
+	}
+
+	if err := cm.RemoveCommand("one"); err != nil {
+		t.Fatal(err)
+	}
+	if info = cmd.Info(); info.State != StateStopping {
+		t.Fatalf("info after stop: %+v", info)
+	}
+}
+
+func TestNewCommandSecretTunnel(t *testing.T) {
+	cm := newTestManager(t, t.TempDir())
+
+	req := &CommandRequest{Command: testPersistentCommand, Tunnel: &TunnelRequest{Type: "xtcp", AllowUsers: []string{"alice"}}}
+	one, err := cm.newCommand(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	two, err := cm.newCommand(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if one.tunnel.Type != "xtcp" || len(one.secretKey) < 32 || one.secretKey == two.secretKey {
+		t.Errorf("secret keys %q and %q for a %s tunnel", one.secretKey, two.secretKey, one.tunnel.Type)
+	}
+
+	if _, err = cm.newCommand(&CommandRequest{Command: testPersistentCommand, Tunnel: &TunnelRequest{Type: "tcp"}}); !errors.Is(err, ErrInvalidPayload) {
+		t.Errorf("tcp secret tunnel: got %v, want an invalid payload", err)
+	}
+
+	// The test handler has no port to publish
+	if err = cm.AddCommand(one); !errors.Is(err, ErrInvalidPayload) {
+		t.Errorf("secret tunnel for a command without a port: got %v, want an invalid payload", err)
+	}
+	if _, err = cm.GetCommand(one.ID); err == nil {
+		t.Error("command kept after it failed to start")
+	}
+}
+
+func TestStopRequest(t *testing.T) {
+	cm := newTestManager(t, t.TempDir())
+	tm := newTestTunnel(t, cm)
+	msgs := recordPublished(cm)
+
+	if result := request(t, cm, msgs, &CommandRequest{RequestID: "req-1", ID: "one", Command: testProxiedCommand}); result.Status != StatusRunning {
+		t.Fatalf("start reply %+v", result)
+	}
+	cmd, err := cm.GetCommand("one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, _ := testProxiedHandlers.GetOk("one")
+	if tm.ProxyStatus("127.0.0.1", h.port) == nil {
+		t.Fatal("port not published")
+	}
+	if len(readRecords(t, cm)) != 1 {
+		t.Fatal("command not persisted")
+	}
+
+	result := request(t, cm, msgs, &CommandRequest{RequestID: "req-2", Command: StopCommand, Payload: &StopRequest{ID: "one"}})
+	if result.Status != StatusSucceeded || result.RequestID != "req-2" {
+		t.Fatalf("stop reply %+v", result)
+	}
+	if output, _ := result.Output.(map[string]interface{}); output["id"] != "one" || output["command"] != testProxiedCommand {
+		t.Errorf("stop output %v", result.Output)
+	}
+
+	stopped := nextResult(t, msgs, resultsSubject())
+	if stopped.Status != StatusStopped || stopped.ID != "one" || stopped.RequestID != "req-1" {
+		t.Errorf("stopped result %+v", stopped)
+	}
+
+	select {
+	case <-h.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("command context not cancelled")
+	}
+	if cmd.ctx.Err() == nil || !h.stopped.Load() {
+		t.Error("handler not stopped")
+	}
+	if tm.ProxyStatus("127.0.0.1", h.port) != nil {
+		t.Error("tunnel proxy kept after stop")
+	}
+	if _, err = cm.GetCommand("one"); err == nil {
+		t.Error("command kept after stop")
+	}
+	if records := readRecords(t, cm); len(records) != 0 {
+		t.Errorf("persisted %d records after stop, want 0", len(records))
+	}
+
+	for _, payload := range []*StopRequest{{ID: "one"}, {}} {
+		if result = request(t, cm, msgs, &CommandRequest{Command: StopCommand, Payload: payload}); result.Status != StatusRejected || result.Error == "" {
+			t.Errorf("stop %+v: reply %+v, want rejected", payload, result)
+		}
+	}
+}
+
+func TestStopRepliesBeforeGracePeriod(t *testing.T) {
+	cm := newTestManager(t, t.TempDir())
+	msgs := recordPublished(cm)
+
+	if result := request(t, cm, msgs, &CommandRequest{RequestID: "req-1", Command: testSessionCommand}); result.Status != StatusRunning {
+		t.Fatalf("start reply %+v", result)
+	}
+	cmd, err := cm.GetCommand(testSessionCommand)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if result := request(t, cm, msgs, &CommandRequest{Command: StopCommand, Payload: &StopRequest{ID: testSessionCommand}}); result.Status != StatusSucceeded {
+		t.Fatalf("stop reply %+v", result)
+	}
+	if elapsed := time.Since(start); elapsed >= shutdownGracePeriod {
+		t.Errorf("stop replied after %s, the grace period held up the request", elapsed)
+	}
+
+	// The command stays until the grace period is over
+	if state := cmd.Info().State; state != StateStopping {
+		t.Errorf("state %s during the grace period, want stopping", state)
+	}
+	if result := request(t, cm, msgs, &CommandRequest{Command: testSessionCommand}); result.Status != StatusRejected {
+		t.Errorf("start during the grace period: reply %+v, want rejected", result)
+	}
+	if result := request(t, cm, msgs, &CommandRequest{Command: StopCommand, Payload: &StopRequest{ID: testSessionCommand}}); result.Status != StatusSucceeded {
+		t.Errorf("repeated stop reply %+v", result)
+	}
+
+	stopped := nextResult(t, msgs, resultsSubject())
+	if stopped.Status != StatusStopped || stopped.RequestID != "req-1" {
+		t.Errorf("stopped result %+v", stopped)
+	}
+	if elapsed := time.Since(start); elapsed < shutdownGracePeriod {
+		t.Errorf("stopped after %s, before the grace period", elapsed)
+	}
+	if cm.commands.Length() != 0 {
+		t.Errorf("%d commands running after stop", cm.commands.Length())
+	}
+
+	// The repeated stop did not tear the command down a second time
+	select {
+	case msg := <-msgs.c:
+		t.Errorf("unexpected message on %s after stop", msg.subject)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestProxyNameCollisionIsRejected(t *testing.T) {
+	cm := newTestManager(t, t.TempDir())
+	tm := newTestTunnel(t, cm)
+	msgs := recordPublished(cm)
+
+	if result := request(t, cm, msgs, &CommandRequest{Command: testProxiedCommand}); result.Status != StatusRunning {
+		t.Fatalf("start reply %+v", result)
+	}
+
+	result := request(t, cm, msgs, &CommandRequest{Command: testProxiedAlias})
+	if result.Status != StatusRejected || !strings.Contains(result.Error, tunnel.ErrProxyNameInUse.Error()) {
+		t.Fatalf("reply to a proxy name in use %+v", result)
+	}
+	if _, err := cm.GetCommand(testProxiedAlias); err == nil {
+		t.Error("rejected command kept")
+	}
+	if h, _ := testProxiedHandlers.GetOk(testProxiedAlias); !h.stopped.Load() {
+		t.Error("handler of the rejected command not stopped")
+	}
+
+	// The first command keeps its proxy
+	first, _ := testProxiedHandlers.GetOk(testProxiedCommand)
+	if tm.ProxyStatus("127.0.0.1", first.port) == nil {
+		t.Error("proxy of the running command removed")
+	}
+}
+
+func testCAPublicKey(t *testing.T) string {
+	t.Helper()
+
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := gossh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(gossh.MarshalAuthorizedKey(key))
+}
+
+func TestSSHInstancesRunSideBySide(t *testing.T) {
+	cm := newTestManager(t, t.TempDir())
+	newTestTunnel(t, cm)
+	msgs := recordPublished(cm)
+	payload := map[string]interface{}{"ca_public_key": testCAPublicKey(t)}
+
+	first := request(t, cm, msgs, &CommandRequest{Command: StartSSHCommand, Payload: payload})
+	if first.Status != StatusRunning || first.ID != StartSSHCommand || first.Tunnel == nil || first.Tunnel.Domain != "my-device" {
+		t.Fatalf("default instance %+v", first)
+	}
+
+	second := request(t, cm, msgs, &CommandRequest{ID: "ssh-alice", Command: StartSSHCommand, Payload: payload})
+	if second.Status != StatusRunning || second.ID != "ssh-alice" || second.Tunnel == nil || second.Tunnel.Domain != "my-device-ssh-alice" {
+		t.Fatalf("second instance %+v", second)
+	}
+	if first.Tunnel.LocalPort == second.Tunnel.LocalPort {
+		t.Errorf("both instances listen on port %d", first.Tunnel.LocalPort)
+	}
+	if ids := commandIDs(cm); len(ids) != 2 {
+		t.Errorf("running %v, want both instances", ids)
+	}
+
+	duplicate := request(t, cm, msgs, &CommandRequest{ID: "ssh-alice", Command: StartSSHCommand, Payload: payload})
+	if duplicate.Status != StatusRejected || duplicate.Error != ErrCommandAlreadyRunning.Error() {
+		t.Errorf("duplicate instance %+v", duplicate)
+	}
+
+	cmd, err := cm.newCommand(&CommandRequest{ID: "ssh-alice", Command: StartSSHCommand, Payload: payload})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cm.AddCommand(cmd); !errors.Is(err, ErrCommandAlreadyRunning) {
+		t.Errorf("AddCommand of a running ID: got %v, want ErrCommandAlreadyRunning", err)
+	}
+}
+
+func TestInvalidInstanceIDIsRejected(t *testing.T) {
+	cm := newTestManager(t, t.TempDir())
+	msgs := recordPublished(cm)
+
+	for _, id := range []string{"SSH", "-ssh", "ssh-", "ssh_alice", "ssh.alice", strings.Repeat("a", 64)} {
+		if _, err := cm.newCommand(&CommandRequest{ID: id, Command: testEphemeralCommand}); err == nil {
+			t.Errorf("newCommand accepted id %q", id)
+		}
+
+		if result := request(t, cm, msgs, &CommandRequest{ID: id, Command: testEphemeralCommand}); result.Status != StatusRejected {
+			t.Errorf("id %q: reply %+v, want rejected", id, result)
+		}
+	}
+
+	if _, err := cm.newCommand(&CommandRequest{ID: strings.Repeat("a", 63), Command: testEphemeralCommand}); err != nil {
+		t.Errorf("63 character id: %v", err)
+	}
+}
+
+func TestCommandProxyName(t *testing.T) {
+	tests := []struct {
+		command string
+		id      string
+		want    string
+	}{
+		{StartSSHCommand, StartSSHCommand, ""},
+		{StartSSHCommand, "ssh-alice", "ssh-alice"},
+		{EnableBeszelAgentCommand, EnableBeszelAgentCommand, "beszel"},
+		{EnableBeszelAgentCommand, "x", "beszel-x"},
+		{ExposeCommand, "dashboard", "expose-dashboard"},
+	}
+
+	for _, tt := range tests {
+		cmd := &Command{Name: tt.command, ID: tt.id}
+		if got := cmd.proxyName(); got != tt.want {
+			t.Errorf("proxy name of %s instance %s = %q, want %q", tt.command, tt.id, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package remote_commands
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCommandRequestExpiry(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) *time.Time {
+		t := now.Add(d)
+		return &t
+	}
+
+	tests := []struct {
+		name       string
+		req        CommandRequest
+		defaultTTL time.Duration
+		maxTTL     time.Duration
+		want       time.Time
+		wantErr    bool
+	}{
+		{name: "no expiry", req: CommandRequest{}},
+		{name: "default ttl", req: CommandRequest{}, defaultTTL: time.Hour, want: now.Add(time.Hour)},
+		{name: "ttl", req: CommandRequest{TTL: 60}, defaultTTL: time.Hour, want: now.Add(time.Minute)},
+		{name: "expires_at", req: CommandRequest{ExpiresAt: at(2 * time.Hour)}, want: now.Add(2 * time.Hour)},
+		{name: "earlier ttl wins", req: CommandRequest{TTL: 60, ExpiresAt: at(time.Hour)}, want: now.Add(time.Minute)},
+		{name: "earlier expires_at wins", req: CommandRequest{TTL: 7200, ExpiresAt: at(time.Hour)}, want: now.Add(time.Hour)},
+		{name: "expires_at in the past", req: CommandRequest{ExpiresAt: at(-time.Minute)}, wantErr: true},
+		{name: "negative ttl", req: CommandRequest{TTL: -1}, wantErr: true},
+		{name: "ttl above max", req: CommandRequest{TTL: 13 * 3600}, maxTTL: 12 * time.Hour, wantErr: true},
+		{name: "expires_at clamped to max", req: CommandRequest{ExpiresAt: at(100 * 365 * 24 * time.Hour)}, maxTTL: 12 * time.Hour, want: now.Add(12 * time.Hour)},
+		{name: "no expiry capped by max", req: CommandRequest{}, maxTTL: 12 * time.Hour, want: now.Add(12 * time.Hour)},
+		{name: "overflowing ttl", req: CommandRequest{TTL: 1 << 62}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.req.Expiry(now, tt.defaultTTL, tt.maxTTL)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got expiry %s", got)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !got.Equal(tt.want) {
+				t.Errorf("got expiry %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
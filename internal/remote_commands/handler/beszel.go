@@ -0,0 +1,259 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultBeszelBinary     = "beszel-agent"
+	defaultBeszelListenPort = 45876
+
+	beszelMinBackoff = time.Second
+	beszelMaxBackoff = 5 * time.Minute
+	// beszelStableRun resets the restart backoff once the agent stayed up this long.
+	beszelStableRun = time.Minute
+	// beszelStopTimeout is how long the agent gets to exit after SIGTERM.
+	beszelStopTimeout = 5 * time.Second
+)
+
+type BeszelConfig struct {
+	ServerURL    string `json:"server_url,omitempty"`
+	Token        string `json:"token,omitempty"`
+	SSHPublicKey string `json:"ssh_public_key"`
+	BinaryPath   string `json:"binary_path,omitempty"`
+	ListenPort   int    `json:"listen_port,omitempty"`
+	// Expose publishes the agent port through the device tunnel so the hub can reach it,
+	// as RemotePort on the tunnel server.
+	Expose     bool `json:"expose,omitempty"`
+	RemotePort int  `json:"remote_port,omitempty"`
+}
+
+func (c *BeszelConfig) Validate() error {
+	if c.SSHPublicKey == "" {
+		return errors.New("ssh_public_key is required")
+	}
+
+	if (c.ServerURL == "") != (c.Token == "") {
+		return errors.New("server_url and token must be set together")
+	}
+
+	if c.ListenPort < 0 || c.ListenPort > 65535 {
+		return fmt.Errorf("invalid listen_port: %d", c.ListenPort)
+	}
+
+	if c.RemotePort < 0 || c.RemotePort > 65535 {
+		return fmt.Errorf("invalid remote_port: %d", c.RemotePort)
+	}
+
+	if c.Expose && c.RemotePort == 0 {
+		return errors.New("remote_port is required to expose the agent")
+	}
+
+	return nil
+}
+
+type BeszelAgentOutput struct {
+	PID        int  `json:"pid,omitempty"`
+	Restarts   int  `json:"restarts"`
+	ListenPort int  `json:"listen_port"`
+	Exposed    bool `json:"exposed"`
+	// Endpoint is the tunnel server address the hub dials, set when the agent is exposed.
+	Endpoint string `json:"endpoint,omitempty"`
+}
+
+// beszelTiming paces the agent restarts and shutdown.
+type beszelTiming struct {
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+	stableRun   time.Duration
+	stopTimeout time.Duration
+}
+
+var defaultBeszelTiming = beszelTiming{
+	minBackoff:  beszelMinBackoff,
+	maxBackoff:  beszelMaxBackoff,
+	stableRun:   beszelStableRun,
+	stopTimeout: beszelStopTimeout,
+}
+
+// restartDelay returns how long to wait before restarting an agent that ran for ran, given the
+// backoff of the previous restart, and the backoff of the next one.
+func (t beszelTiming) restartDelay(backoff, ran time.Duration) (wait, next time.Duration) {
+	wait = backoff
+	if ran >= t.stableRun {
+		wait = t.minBackoff
+	}
+
+	return wait, min(wait*2, t.maxBackoff)
+}
+
+// BeszelAgentHandler supervises a Beszel monitoring agent process, restarting it with backoff when it crashes.
+type BeszelAgentHandler struct {
+	config *BeszelConfig
+	binary string
+	timing beszelTiming
+
+	mu       sync.Mutex
+	cancel   context.CancelFunc
+	done     chan struct{} // Closed when Handle returns
+	pid      int
+	restarts int
+	endpoint string
+}
+
+func NewBeszelAgentHandler(config *BeszelConfig) (*BeszelAgentHandler, error) {
+	if config.ListenPort == 0 {
+		config.ListenPort = defaultBeszelListenPort
+	}
+
+	binary := config.BinaryPath
+	if binary == "" {
+		binary = defaultBeszelBinary
+	}
+
+	path, err := exec.LookPath(binary)
+	if err != nil {
+		return nil, fmt.Errorf("beszel agent binary: %w", err)
+	}
+
+	return &BeszelAgentHandler{
+		config: config,
+		binary: path,
+		timing: defaultBeszelTiming,
+	}, nil
+}
+
+// ListenPort returns the agent port when it should be published through the tunnel.
+func (h *BeszelAgentHandler) ListenPort() int {
+	if !h.config.Expose {
+		return 0
+	}
+
+	return h.config.ListenPort
+}
+
+// RemotePort returns the tunnel server port the agent is published on. Stock hubs dial the
+// agent over plain TCP, so it cannot sit behind the HTTP CONNECT multiplexer.
+func (h *BeszelAgentHandler) RemotePort() int {
+	return h.config.RemotePort
+}
+
+func (h *BeszelAgentHandler) SetTunnelEndpoint(endpoint string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.endpoint = endpoint
+}
+
+func (h *BeszelAgentHandler) Handle(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	h.mu.Lock()
+	h.cancel, h.done = cancel, done
+	h.mu.Unlock()
+
+	backoff := h.timing.minBackoff
+	for {
+		startedAt := time.Now()
+		err := h.runAgent(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		var wait time.Duration
+		wait, backoff = h.timing.restartDelay(backoff, time.Since(startedAt))
+
+		slog.Warn(fmt.Sprintf("Beszel agent exited: %v. Restarting in %s", err, wait))
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(wait):
+		}
+
+		h.mu.Lock()
+		h.restarts++
+		h.mu.Unlock()
+	}
+}
+
+func (h *BeszelAgentHandler) runAgent(ctx context.Context) error {
+	cmd := exec.CommandContext(ctx, h.binary)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("KEY=%s", h.config.SSHPublicKey),
+		fmt.Sprintf("LISTEN=%d", h.config.ListenPort),
+	)
+	if h.config.ServerURL != "" {
+		cmd.Env = append(cmd.Env,
+			fmt.Sprintf("HUB_URL=%s", h.config.ServerURL),
+			fmt.Sprintf("TOKEN=%s", h.config.Token),
+		)
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	cmd.WaitDelay = h.timing.stopTimeout
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	slog.Info("Started Beszel agent", slog.Int("pid", cmd.Process.Pid), slog.Int("port", h.config.ListenPort))
+	h.mu.Lock()
+	h.pid = cmd.Process.Pid
+	h.mu.Unlock()
+
+	err := cmd.Wait()
+
+	h.mu.Lock()
+	h.pid = 0
+	h.mu.Unlock()
+
+	return err
+}
+
+// Stop terminates the agent and waits for the supervisor loop to exit.
+func (h *BeszelAgentHandler) Stop() error {
+	h.mu.Lock()
+	cancel, done := h.cancel, h.done
+	h.mu.Unlock()
+
+	if cancel == nil {
+		return nil
+	}
+
+	cancel()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(2 * h.timing.stopTimeout):
+		return errors.New("timed out waiting for beszel agent to exit")
+	}
+}
+
+func (h *BeszelAgentHandler) Output() interface{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return &BeszelAgentOutput{
+		PID:        h.pid,
+		Restarts:   h.restarts,
+		ListenPort: h.config.ListenPort,
+		Exposed:    h.config.Expose,
+		Endpoint:   h.endpoint,
+	}
+}
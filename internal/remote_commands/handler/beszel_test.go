@@ -0,0 +1,169 @@
+package handler
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newStubAgent returns a Beszel agent handler running script instead of the agent.
+func newStubAgent(t *testing.T, cfg *BeszelConfig, script string) *BeszelAgentHandler {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "beszel-agent")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.BinaryPath = path
+	if cfg.SSHPublicKey == "" {
+		cfg.SSHPublicKey = "ssh-ed25519 AAAA"
+	}
+
+	h, err := NewBeszelAgentHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return h
+}
+
+// handle runs the supervisor until the test ends.
+func handle(t *testing.T, h *BeszelAgentHandler) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = h.Handle(ctx)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func waitFor(t *testing.T, what string, ok func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !ok() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func beszelOutput(h *BeszelAgentHandler) *BeszelAgentOutput {
+	return h.Output().(*BeszelAgentOutput)
+}
+
+func TestBeszelRestartDelay(t *testing.T) {
+	timing := beszelTiming{minBackoff: time.Second, maxBackoff: 8 * time.Second, stableRun: time.Minute}
+
+	tests := []struct {
+		name      string
+		backoff   time.Duration
+		ran       time.Duration
+		wait      time.Duration
+		nextDelay time.Duration
+	}{
+		{"first crash", time.Second, 0, time.Second, 2 * time.Second},
+		{"doubles", 2 * time.Second, time.Second, 2 * time.Second, 4 * time.Second},
+		{"capped", 8 * time.Second, time.Second, 8 * time.Second, 8 * time.Second},
+		{"reset after a stable run", 8 * time.Second, time.Minute, time.Second, 2 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wait, next := timing.restartDelay(tt.backoff, tt.ran)
+			if wait != tt.wait || next != tt.nextDelay {
+				t.Errorf("restartDelay(%s, %s) = %s, %s, want %s, %s", tt.backoff, tt.ran, wait, next, tt.wait, tt.nextDelay)
+			}
+		})
+	}
+}
+
+func TestBeszelAgentRestartsWithBackoff(t *testing.T) {
+	runs := filepath.Join(t.TempDir(), "runs")
+	h := newStubAgent(t, &BeszelConfig{}, "echo run >> "+runs+"\nexit 1")
+	h.timing = beszelTiming{minBackoff: 20 * time.Millisecond, maxBackoff: 80 * time.Millisecond, stableRun: time.Hour, stopTimeout: time.Second}
+
+	start := time.Now()
+	handle(t, h)
+	waitFor(t, "4 restarts", func() bool {
+		return beszelOutput(h).Restarts >= 4
+	})
+
+	// The restarts waited 20, 40, 80 and 80 milliseconds
+	if elapsed := time.Since(start); elapsed < 220*time.Millisecond {
+		t.Errorf("4 restarts after %s, backoff not applied", elapsed)
+	}
+
+	data, err := os.ReadFile(runs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "run"); n < 4 {
+		t.Errorf("agent ran %d times for 4 restarts", n)
+	}
+}
+
+func TestBeszelAgentEnvironment(t *testing.T) {
+	env := filepath.Join(t.TempDir(), "env")
+	h := newStubAgent(t, &BeszelConfig{ServerURL: "https://hub.example.com", Token: "hub-token", ListenPort: 45999},
+		`printf '%s\n' "$HUB_URL" "$TOKEN" "$KEY" "$LISTEN" > `+env+".tmp && mv "+env+".tmp "+env+"\nexec sleep 60")
+
+	handle(t, h)
+	waitFor(t, "the agent to start", func() bool {
+		_, err := os.Stat(env)
+		return err == nil && beszelOutput(h).PID != 0
+	})
+
+	data, err := os.ReadFile(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "https://hub.example.com\nhub-token\nssh-ed25519 AAAA\n45999\n"
+	if string(data) != want {
+		t.Errorf("agent environment %q, want %q", data, want)
+	}
+
+	start := time.Now()
+	if err = h.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed >= beszelStopTimeout {
+		t.Errorf("Stop took %s", elapsed)
+	}
+	if output := beszelOutput(h); output.PID != 0 || output.Restarts != 0 {
+		t.Errorf("output after Stop %+v", output)
+	}
+}
+
+func TestBeszelAgentStopKillsStuckAgent(t *testing.T) {
+	ready := filepath.Join(t.TempDir(), "ready")
+	h := newStubAgent(t, &BeszelConfig{}, "trap '' TERM\ntouch "+ready+"\nexec sleep 60")
+	h.timing = defaultBeszelTiming
+	h.timing.stopTimeout = 200 * time.Millisecond
+
+	handle(t, h)
+	waitFor(t, "the agent to ignore SIGTERM", func() bool {
+		_, err := os.Stat(ready)
+		return err == nil
+	})
+
+	start := time.Now()
+	if err := h.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < h.timing.stopTimeout || elapsed >= 2*h.timing.stopTimeout {
+		t.Errorf("Stop took %s with a stop timeout of %s", elapsed, h.timing.stopTimeout)
+	}
+}
@@ -0,0 +1,249 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultExecShell = "/bin/sh"
+	// execStopTimeout is how long the process group gets to exit after SIGTERM.
+	execStopTimeout = 5 * time.Second
+)
+
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+)
+
+// OutputFunc receives chunks of a handler's output as they are produced.
+type OutputFunc func(stream string, data []byte)
+
+type ExecConfig struct {
+	// Argv runs a program directly, Script runs through Shell. Exactly one must be set.
+	Argv    []string          `json:"argv,omitempty"`
+	Script  string            `json:"script,omitempty"`
+	Shell   string            `json:"shell,omitempty"`
+	Timeout int64             `json:"timeout,omitempty"` // Seconds, 0 means no timeout
+	Dir     string            `json:"dir,omitempty"`
+	Env     map[string]string `json:"env,omitempty"`
+	User    string            `json:"user,omitempty"` // Local account to run as, defaults to the daemon user
+}
+
+func (c *ExecConfig) Validate() error {
+	if (len(c.Argv) == 0) == (c.Script == "") {
+		return errors.New("exactly one of argv and script is required")
+	}
+
+	if len(c.Argv) > 0 && c.Argv[0] == "" {
+		return errors.New("argv[0] is empty")
+	}
+
+	if c.Timeout < 0 || c.Timeout > int64(24*time.Hour/time.Second) {
+		return fmt.Errorf("invalid timeout: %d", c.Timeout)
+	}
+
+	return nil
+}
+
+type ExecOutput struct {
+	PID      int  `json:"pid,omitempty"`
+	ExitCode *int `json:"exit_code,omitempty"`
+	TimedOut bool `json:"timed_out,omitempty"`
+}
+
+// ExecHandler runs a single program or script, streaming its output, and ends when it exits.
+type ExecHandler struct {
+	config *ExecConfig
+	output OutputFunc
+
+	mu       sync.Mutex
+	cancel   context.CancelFunc
+	done     chan struct{} // Closed when Handle returns
+	pid      int
+	exitCode *int
+	timedOut bool
+}
+
+func NewExecHandler(config *ExecConfig, output OutputFunc) (*ExecHandler, error) {
+	if config.Shell == "" {
+		config.Shell = defaultExecShell
+	}
+
+	return &ExecHandler{
+		config: config,
+		output: output,
+		done:   make(chan struct{}),
+	}, nil
+}
+
+func (h *ExecHandler) Handle(ctx context.Context) error {
+	defer close(h.done)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var timeout <-chan time.Time
+	if h.config.Timeout > 0 {
+		timer := time.NewTimer(time.Duration(h.config.Timeout) * time.Second)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	h.mu.Lock()
+	h.cancel = cancel
+	h.mu.Unlock()
+
+	cmd, err := h.command(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+
+	pid := cmd.Process.Pid
+	slog.Info("Started exec command", slog.Int("pid", pid), slog.String("path", cmd.Path))
+	h.mu.Lock()
+	h.pid = pid
+	h.mu.Unlock()
+
+	waitErr := make(chan error, 1)
+	go func() {
+		waitErr <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-waitErr:
+	case <-timeout:
+		h.mu.Lock()
+		h.timedOut = true
+		h.mu.Unlock()
+
+		cancel()
+		err = <-waitErr
+	}
+
+	// Reap whatever the command left behind in its process group
+	_ = syscall.Kill(-pid, syscall.SIGKILL)
+
+	code := cmd.ProcessState.ExitCode()
+	h.mu.Lock()
+	h.exitCode = &code
+	timedOut := h.timedOut
+	h.mu.Unlock()
+
+	switch {
+	case timedOut:
+		return fmt.Errorf("timed out after %ds", h.config.Timeout)
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case code != 0:
+		return fmt.Errorf("exit code %d", code)
+	}
+
+	return err
+}
+
+func (h *ExecHandler) command(ctx context.Context) (*exec.Cmd, error) {
+	argv := h.config.Argv
+	if h.config.Script != "" {
+		argv = []string{h.config.Shell, "-c", h.config.Script}
+	}
+
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Dir = h.config.Dir
+	cmd.Env = os.Environ()
+	// Own process group, so cancellation reaches every child of the command
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if h.config.User != "" {
+		u, credential, err := lookupCredential(h.config.User)
+		if err != nil {
+			return nil, fmt.Errorf("user %s: %w", h.config.User, err)
+		}
+
+		cmd.SysProcAttr.Credential = credential
+		cmd.Env = []string{
+			"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+			fmt.Sprintf("HOME=%s", u.HomeDir),
+			fmt.Sprintf("USER=%s", u.Username),
+			fmt.Sprintf("LOGNAME=%s", u.Username),
+		}
+		if cmd.Dir == "" {
+			cmd.Dir = u.HomeDir
+		}
+	}
+
+	keys := make([]string, 0, len(h.config.Env))
+	for k := range h.config.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, h.config.Env[k]))
+	}
+
+	cmd.Stdout = &streamWriter{stream: StreamStdout, output: h.output}
+	cmd.Stderr = &streamWriter{stream: StreamStderr, output: h.output}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+	}
+	cmd.WaitDelay = execStopTimeout
+
+	return cmd, nil
+}
+
+// Stop kills the process group and waits for Handle to return.
+func (h *ExecHandler) Stop() error {
+	h.mu.Lock()
+	cancel := h.cancel
+	h.mu.Unlock()
+
+	if cancel == nil {
+		return nil
+	}
+
+	cancel()
+	select {
+	case <-h.done:
+		return nil
+	case <-time.After(2 * execStopTimeout):
+		return errors.New("timed out waiting for command to exit")
+	}
+}
+
+func (h *ExecHandler) Output() interface{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return &ExecOutput{
+		PID:      h.pid,
+		ExitCode: h.exitCode,
+		TimedOut: h.timedOut,
+	}
+}
+
+// streamWriter forwards every write of a process stream to an OutputFunc.
+type streamWriter struct {
+	stream string
+	output OutputFunc
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	if w.output != nil {
+		w.output(w.stream, append([]byte(nil), p...))
+	}
+
+	return len(p), nil
+}
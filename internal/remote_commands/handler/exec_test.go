@@ -0,0 +1,104 @@
+package handler
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type collectedOutput struct {
+	mu      sync.Mutex
+	streams map[string]*strings.Builder
+}
+
+func (o *collectedOutput) write(stream string, data []byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.streams[stream] == nil {
+		o.streams[stream] = &strings.Builder{}
+	}
+	o.streams[stream].Write(data)
+}
+
+func (o *collectedOutput) get(stream string) string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.streams[stream] == nil {
+		return ""
+	}
+	return o.streams[stream].String()
+}
+
+func TestExecHandlerStreamsOutputAndExitCode(t *testing.T) {
+	out := &collectedOutput{streams: map[string]*strings.Builder{}}
+	h, err := NewExecHandler(&ExecConfig{
+		Script: `echo "$GREETING"; echo oops >&2; exit 3`,
+		Env:    map[string]string{"GREETING": "hello"},
+	}, out.write)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = h.Handle(context.Background()); err == nil {
+		t.Fatal("expected a non-zero exit to fail the command")
+	}
+
+	if got := out.get(StreamStdout); got != "hello\n" {
+		t.Errorf("stdout %q", got)
+	}
+	if got := out.get(StreamStderr); got != "oops\n" {
+		t.Errorf("stderr %q", got)
+	}
+
+	output := h.Output().(*ExecOutput)
+	if output.ExitCode == nil || *output.ExitCode != 3 {
+		t.Errorf("exit code %v, want 3", output.ExitCode)
+	}
+}
+
+func TestExecHandlerTimeoutKillsProcessGroup(t *testing.T) {
+	h, err := NewExecHandler(&ExecConfig{Script: "sleep 30 & sleep 30", Timeout: 1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if err = h.Handle(context.Background()); err == nil {
+		t.Fatal("expected the timeout to fail the command")
+	}
+
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("command ran for %s after its timeout", elapsed)
+	}
+
+	if !h.Output().(*ExecOutput).TimedOut {
+		t.Error("output does not report the timeout")
+	}
+}
+
+func TestExecHandlerStop(t *testing.T) {
+	h, err := NewExecHandler(&ExecConfig{Argv: []string{"sleep", "30"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- h.Handle(context.Background())
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	if err = h.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Handle did not return after Stop")
+	}
+}
@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"context"
+	"sync"
+
+	"github.com/Fyve-Labs/tessa-daemon/internal/tunnel"
+)
+
+// ExposeConfig publishes a local service, e.g. a dashboard or an MQTT broker, through the device tunnel.
+type ExposeConfig struct {
+	// Type is tcp, udp, http or https.
+	Type      string `json:"type"`
+	LocalIP   string `json:"local_ip,omitempty"` // Defaults to 127.0.0.1
+	LocalPort int    `json:"local_port"`
+	// RemotePort is the tunnel server port of tcp and udp services.
+	RemotePort int `json:"remote_port,omitempty"`
+	// Subdomain of http and https services, defaults to the tunnel proxy name.
+	Subdomain string           `json:"subdomain,omitempty"`
+	BasicAuth *BasicAuthConfig `json:"basic_auth,omitempty"`
+}
+
+// BasicAuthConfig protects an http service with a user and password.
+type BasicAuthConfig struct {
+	User     string `json:"user"`
+	Password string `json:"password"`
+}
+
+func (c *ExposeConfig) Validate() error {
+	svc := c.service("")
+	return svc.Validate()
+}
+
+func (c *ExposeConfig) service(name string) tunnel.Service {
+	svc := tunnel.Service{
+		Name:       name,
+		Type:       c.Type,
+		LocalIP:    c.LocalIP,
+		LocalPort:  c.LocalPort,
+		RemotePort: c.RemotePort,
+		Subdomain:  c.Subdomain,
+	}
+	if c.BasicAuth != nil {
+		svc.HTTPUser, svc.HTTPPassword = c.BasicAuth.User, c.BasicAuth.Password
+	}
+
+	return svc
+}
+
+// ServicePublisher publishes local services through the device tunnel, see tunnel.Manager.
+type ServicePublisher interface {
+	Expose(svc tunnel.Service) (*tunnel.Service, error)
+	Unexpose(name string) bool
+}
+
+// ExposeHandler keeps a local service published through the tunnel until it is stopped.
+type ExposeHandler struct {
+	publisher ServicePublisher
+	service   *tunnel.Service
+
+	stopOnce sync.Once
+	stopped  chan struct{}
+}
+
+// NewExposeHandler publishes the service under name right away, so the start result carries its
+// endpoint or the reason it could not be published.
+func NewExposeHandler(name string, config *ExposeConfig, publisher ServicePublisher) (*ExposeHandler, error) {
+	svc, err := publisher.Expose(config.service(name))
+	if err != nil {
+		return nil, err
+	}
+
+	return &ExposeHandler{
+		publisher: publisher,
+		service:   svc,
+		stopped:   make(chan struct{}),
+	}, nil
+}
+
+func (h *ExposeHandler) Handle(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+	case <-h.stopped:
+	}
+
+	return nil
+}
+
+// Stop unpublishes the service.
+func (h *ExposeHandler) Stop() error {
+	h.stopOnce.Do(func() {
+		h.publisher.Unexpose(h.service.Name)
+		close(h.stopped)
+	})
+
+	return nil
+}
+
+func (h *ExposeHandler) Output() interface{} {
+	return h.service
+}
@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Fyve-Labs/tessa-daemon/internal/tunnel"
+)
+
+type fakePublisher struct {
+	services map[string]tunnel.Service
+	err      error
+}
+
+func (p *fakePublisher) Expose(svc tunnel.Service) (*tunnel.Service, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	svc.Endpoint = svc.Subdomain
+	p.services[svc.Name] = svc
+	return &svc, nil
+}
+
+func (p *fakePublisher) Unexpose(name string) bool {
+	_, ok := p.services[name]
+	delete(p.services, name)
+	return ok
+}
+
+func TestExposeConfigValidate(t *testing.T) {
+	valid := &ExposeConfig{Type: "http", LocalPort: 8080, BasicAuth: &BasicAuthConfig{User: "admin", Password: "secret"}}
+	if err := valid.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	invalid := &ExposeConfig{Type: "tcp", LocalPort: 1883, BasicAuth: &BasicAuthConfig{User: "admin", Password: "secret"}}
+	if err := invalid.Validate(); err == nil {
+		t.Error("basic auth on a tcp service accepted")
+	}
+}
+
+func TestExposeHandler(t *testing.T) {
+	publisher := &fakePublisher{services: make(map[string]tunnel.Service)}
+	cfg := &ExposeConfig{Type: "http", LocalPort: 8080, Subdomain: "dashboard", BasicAuth: &BasicAuthConfig{User: "admin", Password: "secret"}}
+
+	h, err := NewExposeHandler("dashboard", cfg, publisher)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svc, ok := publisher.services["dashboard"]
+	if !ok || svc.HTTPUser != "admin" || svc.HTTPPassword != "secret" || svc.LocalPort != 8080 {
+		t.Fatalf("published %+v", svc)
+	}
+	if out := h.Output().(*tunnel.Service); out.Endpoint != "dashboard" {
+		t.Errorf("output endpoint = %q", out.Endpoint)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- h.Handle(context.Background())
+	}()
+
+	_ = h.Stop()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Handle did not return after Stop")
+	}
+
+	if _, ok = publisher.services["dashboard"]; ok {
+		t.Error("service still exposed after Stop")
+	}
+}
+
+func TestExposeHandlerPublishError(t *testing.T) {
+	publisher := &fakePublisher{err: errors.New("tunnel proxy in use")}
+	if _, err := NewExposeHandler("dashboard", &ExposeConfig{Type: "https", LocalPort: 8443}, publisher); err == nil {
+		t.Error("handler created for a service that could not be published")
+	}
+}
@@ -1,25 +1,90 @@
 package handler
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"time"
 )
 
+// Handler runs a remote command until its context is cancelled or Stop is called.
 type Handler interface {
 	Handle(ctx context.Context) error
 	Stop() error
+	// Output returns handler-specific data reported in command results, or nil.
+	Output() interface{}
 }
 
+// Notifier is implemented by handlers that can broadcast a message to their connected users.
+type Notifier interface {
+	Notify(message string)
+}
+
+// Proxied is implemented by handlers serving a local port that is published through the device tunnel.
+type Proxied interface {
+	// ListenPort returns the local port to publish, or 0 to keep the handler private.
+	ListenPort() int
+}
+
+// TCPProxied is implemented by proxied handlers whose clients dial plain TCP, e.g. a Beszel hub.
+// They are published on a port of the tunnel server instead of behind the HTTP CONNECT multiplexer.
+type TCPProxied interface {
+	Proxied
+	// RemotePort returns the tunnel server port to publish on, or 0 to use the multiplexer.
+	RemotePort() int
+}
+
+// ProxyProtocolAware is implemented by proxied handlers that read the PROXY protocol header
+// the tunnel can prepend to connections, to learn the real client address.
+type ProxyProtocolAware interface {
+	ProxyProtocol() bool
+}
+
+// Exposed is implemented by handlers that report the tunnel endpoint their port is reachable at.
+type Exposed interface {
+	SetTunnelEndpoint(endpoint string)
+}
+
+// Revocable is implemented by handlers that cut off users whose credentials were revoked while
+// they were connected.
+type Revocable interface {
+	// DisconnectRevoked closes the revoked connections and returns how many there were.
+	DisconnectRevoked() int
+}
+
+// SessionTracker is implemented by handlers that let operators list and disconnect their users.
+type SessionTracker interface {
+	Sessions() []*SSHSessionOutput
+	// Disconnect closes the matching sessions, after writing message to them and waiting delay
+	// if a message is set. It returns how many sessions matched.
+	Disconnect(filter SSHSessionFilter, message string, delay time.Duration) int
+}
+
+// Validator is implemented by command payloads that check their own fields.
+type Validator interface {
+	Validate() error
+}
+
+// JsonPayloadToConfig decodes a command payload into T, rejecting unknown fields,
+// and validates it when T implements Validator.
 func JsonPayloadToConfig[T interface{}](payload interface{}) (*T, error) {
 	var config T
-	bytes, err := json.Marshal(payload)
+	data, err := json.Marshal(payload)
 	if err != nil {
 		return nil, err
 	}
 
-	if err = json.Unmarshal(bytes, &config); err != nil {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(&config); err != nil {
 		return nil, err
 	}
 
+	if v, ok := any(&config).(Validator); ok {
+		if err = v.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
 	return &config, nil
 }
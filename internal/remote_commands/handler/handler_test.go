@@ -0,0 +1,46 @@
+package handler
+
+import (
+	"testing"
+)
+
+func TestJsonPayloadToConfig(t *testing.T) {
+	cfg, err := JsonPayloadToConfig[BeszelConfig](map[string]interface{}{
+		"ssh_public_key": "ssh-ed25519 AAAA",
+		"listen_port":    45000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.SSHPublicKey != "ssh-ed25519 AAAA" || cfg.ListenPort != 45000 {
+		t.Errorf("decoded %+v", cfg)
+	}
+}
+
+func TestJsonPayloadToConfigRejectsUnknownFields(t *testing.T) {
+	_, err := JsonPayloadToConfig[BeszelConfig](map[string]interface{}{
+		"ssh_public_key": "ssh-ed25519 AAAA",
+		"listen":         45000,
+	})
+	if err == nil {
+		t.Fatal("expected unknown field to be rejected")
+	}
+}
+
+func TestJsonPayloadToConfigValidates(t *testing.T) {
+	tests := map[string]interface{}{
+		"missing required field": map[string]interface{}{},
+		"token without url":      map[string]interface{}{"ssh_public_key": "k", "token": "t"},
+		"expose without port":    map[string]interface{}{"ssh_public_key": "k", "expose": true},
+		"invalid port":           map[string]interface{}{"ssh_public_key": "k", "listen_port": 70000},
+	}
+
+	for name, payload := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := JsonPayloadToConfig[BeszelConfig](payload); err == nil {
+				t.Fatal("expected a validation error")
+			}
+		})
+	}
+}
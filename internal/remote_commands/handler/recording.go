@@ -0,0 +1,308 @@
+package handler
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// DefaultRecordingRetention caps the total size of finished recordings when no retention is set.
+const DefaultRecordingRetention = 64 << 20
+
+const (
+	RecordingExt     = ".cast"
+	recordingPartExt = ".part"
+)
+
+// Recorder saves the terminal of every SSH session as an asciicast v2 file.
+type Recorder struct {
+	Dir string
+	// CommandID tags recordings with the command instance that served the session.
+	CommandID string
+	// Input also records what clients type, which can include passwords.
+	Input bool
+	// Retention caps the total size of finished recordings in Dir, the oldest are deleted first.
+	Retention int64
+	// Finished is called with the path of every finished recording, before retention is applied.
+	Finished func(path string)
+
+	seq atomic.Int64
+}
+
+// recordingHeader is the first line of an asciicast v2 file. Players ignore the extra fields
+// tagging the session.
+type recordingHeader struct {
+	Version    int               `json:"version"`
+	Width      int               `json:"width"`
+	Height     int               `json:"height"`
+	Timestamp  int64             `json:"timestamp"`
+	Command    string            `json:"command,omitempty"`
+	Env        map[string]string `json:"env,omitempty"`
+	CommandID  string            `json:"command_id"`
+	KeyID      string            `json:"key_id"`
+	User       string            `json:"user"`
+	RemoteAddr string            `json:"remote_addr"`
+}
+
+// sessionRecording writes the events of a session. A nil recording discards everything.
+type sessionRecording struct {
+	path        string
+	recordInput bool
+	start       time.Time
+
+	mu      sync.Mutex
+	f       *os.File
+	w       *bufio.Writer
+	pending map[string][]byte // Incomplete UTF-8 sequences at the end of the last write, by event type
+	err     error
+}
+
+// start creates the recording of a session, named after the command instance, start time and session.
+func (r *Recorder) start(s ssh.Session) (*sessionRecording, error) {
+	if err := os.MkdirAll(r.Dir, 0700); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	name := fmt.Sprintf("%s-%s-%.8s-%d%s", r.CommandID, now.Format("20060102T150405Z"),
+		s.Context().SessionID(), r.seq.Add(1), RecordingExt)
+	path := filepath.Join(r.Dir, name)
+
+	f, err := os.OpenFile(path+recordingPartExt, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	header := &recordingHeader{
+		Version:    2,
+		Width:      80,
+		Height:     24,
+		Timestamp:  now.Unix(),
+		Command:    s.RawCommand(),
+		CommandID:  r.CommandID,
+		KeyID:      contextKeyID(s.Context()),
+		User:       s.User(),
+		RemoteAddr: s.RemoteAddr().String(),
+	}
+	if ptyReq, _, isPty := s.Pty(); isPty {
+		header.Width, header.Height = ptyReq.Window.Width, ptyReq.Window.Height
+		header.Env = map[string]string{"TERM": ptyReq.Term}
+	}
+
+	rec := &sessionRecording{
+		path:        path,
+		recordInput: r.Input,
+		start:       now,
+		f:           f,
+		w:           bufio.NewWriter(f),
+		pending:     make(map[string][]byte),
+	}
+
+	data, _ := json.Marshal(header)
+	rec.writeLine(data)
+	if rec.err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return nil, rec.err
+	}
+
+	return rec, nil
+}
+
+// finish hands a finished recording over and deletes the oldest recordings above the retention.
+func (r *Recorder) finish(rec *sessionRecording) {
+	path, err := rec.close()
+	if err != nil {
+		slog.Error(fmt.Sprintf("session recording: %v", err), "path", path)
+		return
+	}
+
+	if r.Finished != nil {
+		r.Finished(path)
+	}
+
+	r.prune(path)
+}
+
+// prune deletes finished recordings, oldest first, until they fit in the retention. The
+// recording at keep is never deleted.
+func (r *Recorder) prune(keep string) {
+	retention := r.Retention
+	if retention <= 0 {
+		retention = DefaultRecordingRetention
+	}
+
+	entries, err := os.ReadDir(r.Dir)
+	if err != nil {
+		slog.Warn(fmt.Sprintf("list session recordings: %v", err))
+		return
+	}
+
+	type recording struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+
+	var total int64
+	recordings := make([]recording, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), RecordingExt) {
+			continue
+		}
+
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+
+		total += info.Size()
+		recordings = append(recordings, recording{filepath.Join(r.Dir, e.Name()), info.Size(), info.ModTime()})
+	}
+
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].modTime.Before(recordings[j].modTime)
+	})
+
+	for _, rec := range recordings {
+		if total <= retention {
+			break
+		}
+
+		if rec.path == keep {
+			continue
+		}
+
+		if err := os.Remove(rec.path); err != nil {
+			slog.Warn(fmt.Sprintf("delete session recording: %v", err))
+			continue
+		}
+		total -= rec.size
+		slog.Info("Deleted session recording over retention", "path", rec.path)
+	}
+}
+
+// output returns a writer recording the terminal output of the session.
+func (rec *sessionRecording) output() io.Writer {
+	if rec == nil {
+		return io.Discard
+	}
+
+	return &recordingWriter{rec: rec, code: "o"}
+}
+
+// input returns a writer recording what the client types, if input is recorded.
+func (rec *sessionRecording) input() io.Writer {
+	if rec == nil || !rec.recordInput {
+		return io.Discard
+	}
+
+	return &recordingWriter{rec: rec, code: "i"}
+}
+
+func (rec *sessionRecording) resize(width, height int) {
+	if rec == nil {
+		return
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	rec.writeEvent("r", fmt.Sprintf("%dx%d", width, height))
+}
+
+// record writes an event for data, holding back a multi-byte character cut off at its end
+// until the next write completes it.
+func (rec *sessionRecording) record(code string, data []byte) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	data = append(rec.pending[code], data...)
+	n := completeUTF8(data)
+	rec.pending[code] = append([]byte(nil), data[n:]...)
+
+	if n > 0 {
+		rec.writeEvent(code, string(data[:n]))
+	}
+}
+
+func (rec *sessionRecording) writeEvent(code, data string) {
+	elapsed := math.Round(time.Since(rec.start).Seconds()*1e6) / 1e6
+	line, _ := json.Marshal([]interface{}{elapsed, code, data})
+	rec.writeLine(line)
+}
+
+func (rec *sessionRecording) writeLine(line []byte) {
+	if rec.err != nil || rec.f == nil {
+		return
+	}
+
+	if _, err := rec.w.Write(append(line, '\n')); err != nil {
+		rec.err = err
+	}
+}
+
+// close flushes the recording and moves it to its final name, it returns the final path.
+func (rec *sessionRecording) close() (string, error) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	for code, data := range rec.pending {
+		if len(data) > 0 {
+			rec.writeEvent(code, string(data))
+		}
+	}
+
+	if rec.err == nil {
+		rec.err = rec.w.Flush()
+	}
+
+	if err := rec.f.Close(); err != nil && rec.err == nil {
+		rec.err = err
+	}
+	rec.f = nil
+
+	if rec.err != nil {
+		return rec.path, rec.err
+	}
+
+	return rec.path, os.Rename(rec.path+recordingPartExt, rec.path)
+}
+
+// recordingWriter never fails, so a recording error does not break the session it tees.
+type recordingWriter struct {
+	rec  *sessionRecording
+	code string
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.rec.record(w.code, p)
+	return len(p), nil
+}
+
+// completeUTF8 returns the length of p without a multi-byte character cut off at its end.
+func completeUTF8(p []byte) int {
+	for i := len(p) - 1; i >= 0 && i >= len(p)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(p[i]) {
+			if !utf8.FullRune(p[i:]) {
+				return i
+			}
+			break
+		}
+	}
+
+	return len(p)
+}
@@ -0,0 +1,126 @@
+package handler
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSSHServerRecordsSessions(t *testing.T) {
+	finished := make(chan string, 1)
+	recorder := &Recorder{
+		Dir:       t.TempDir(),
+		CommandID: "start-ssh",
+		Finished:  func(path string) { finished <- path },
+	}
+
+	ca := newTestCA(t)
+	h := startTestServerWithOptions(t, ca, nil, SSHServerOptions{Recorder: recorder})
+
+	login := currentUser(t)
+	client, err := dialTestServer(t, h, login, ca.sign(t, login, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stdout, _, code := runTestCommand(t, client, "echo héllo"); stdout != "héllo\n" || code != 0 {
+		t.Fatalf("got stdout %q, exit %d", stdout, code)
+	}
+
+	var path string
+	select {
+	case path = <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("recording was not finished")
+	}
+
+	if filepath.Ext(path) != RecordingExt {
+		t.Fatalf("unexpected recording name %s", path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		t.Fatal("empty recording")
+	}
+
+	var header recordingHeader
+	if err = json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		t.Fatal(err)
+	}
+	if header.Version != 2 || header.CommandID != "start-ssh" || header.KeyID != "test@example.com" ||
+		header.User != login || header.Command != "echo héllo" {
+		t.Fatalf("unexpected header %+v", header)
+	}
+
+	var output strings.Builder
+	for scanner.Scan() {
+		var event []interface{}
+		if err = json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatal(err)
+		}
+		if len(event) != 3 {
+			t.Fatalf("unexpected event %s", scanner.Text())
+		}
+		if event[1] == "o" {
+			output.WriteString(event[2].(string))
+		}
+	}
+
+	if output.String() != "héllo\n" {
+		t.Fatalf("recorded output %q", output.String())
+	}
+}
+
+func TestRecorderPrune(t *testing.T) {
+	dir := t.TempDir()
+	recorder := &Recorder{Dir: dir, Retention: 25}
+
+	now := time.Now()
+	for i, name := range []string{"a.cast", "b.cast", "c.cast", "d.cast.part"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, make([]byte, 10), 0600); err != nil {
+			t.Fatal(err)
+		}
+		mtime := now.Add(time.Duration(i) * time.Minute)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a.cast is the oldest, but kept as the recording just finished
+	recorder.prune(filepath.Join(dir, "a.cast"))
+
+	for name, exists := range map[string]bool{"a.cast": true, "b.cast": false, "c.cast": true, "d.cast.part": true} {
+		if _, err := os.Stat(filepath.Join(dir, name)); (err == nil) != exists {
+			t.Errorf("%s: exists %v, want %v", name, err == nil, exists)
+		}
+	}
+}
+
+func TestCompleteUTF8(t *testing.T) {
+	for _, tc := range []struct {
+		data string
+		want int
+	}{
+		{"", 0},
+		{"abc", 3},
+		{"h\xc3\xa9", 3},
+		{"h\xc3", 1},
+		{"\xe2\x82", 0},
+		{"\xff", 1},
+	} {
+		if got := completeUTF8([]byte(tc.data)); got != tc.want {
+			t.Errorf("completeUTF8(%q) = %d, want %d", tc.data, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,459 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+)
+
+// SFTPServerCommand is the hidden tessad subcommand serving SFTP on stdin/stdout. The SSH
+// server runs it as a child process so file access happens with the session user's permissions.
+const SFTPServerCommand = "sftp-server"
+
+// sftpServerArgs returns the arguments of the SFTP server child process.
+func sftpServerArgs(root string, allowedPaths []string) []string {
+	args := []string{SFTPServerCommand}
+	if root != "" {
+		args = append(args, "--root", root)
+	}
+
+	for _, p := range allowedPaths {
+		args = append(args, "--allow", p)
+	}
+
+	return args
+}
+
+// handleSFTP runs the SFTP server child process for a session's sftp subsystem request.
+func (h *SSHServerHandler) handleSFTP(s ssh.Session) {
+	// A forced command replaces the subsystem, like in OpenSSH
+	if forced := forceCommand(s.Context()); forced != "" && forced != internalSFTP {
+		h.handleSession(s)
+		return
+	}
+
+	h.trackSession(s, true)
+	defer h.trackSession(s, false)
+
+	code := 0
+	if err := h.runSFTP(s); err != nil {
+		slog.Warn(fmt.Sprintf("SFTP session: %v", err), "user", s.User(), "addr", s.RemoteAddr())
+		code = 1
+	}
+
+	_ = s.Exit(code)
+}
+
+func (h *SSHServerHandler) runSFTP(s ssh.Session) error {
+	u := contextLoginUser(s.Context())
+	if u == nil {
+		return errors.New("no login user")
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	// The server runs as the login user, in its home directory
+	cmd := exec.Command(executable, sftpServerArgs(h.sftpRoot, h.sftpAllowedPaths)...)
+	cmd.Dir = u.HomeDir
+	cmd.Env = u.env()
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Credential: u.credential}
+	cmd.Stdout = s
+	cmd.Stderr = s.Stderr()
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+
+	go func() {
+		_, _ = io.Copy(stdin, s)
+		_ = stdin.Close()
+	}()
+	go func() {
+		<-s.Context().Done()
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}()
+
+	return cmd.Wait()
+}
+
+// ServeSFTP serves the SFTP protocol on in/out until the client disconnects. When root is set
+// clients are confined to it and see it as "/", allowedPaths (inside root, if set) further limits
+// them to these directories.
+func ServeSFTP(in io.Reader, out io.WriteCloser, root string, allowedPaths []string) error {
+	fs, err := newSFTPFileSystem(root, allowedPaths)
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+
+	handlers := sftp.Handlers{FileGet: fs, FilePut: fs, FileCmd: fs, FileList: fs}
+	server := sftp.NewRequestServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{in, out}, handlers, sftp.WithStartDirectory(fs.startDirectory()))
+	defer server.Close()
+
+	if err = server.Serve(); err == io.EOF {
+		return nil
+	}
+
+	return err
+}
+
+// sftpMount exposes a directory of the device at path in the SFTP file system. Access goes through
+// an os.Root, so symlinks cannot escape the mount.
+type sftpMount struct {
+	path string
+	root *os.Root
+}
+
+// sftpFileSystem implements the pkg/sftp request handlers on a set of mounts.
+type sftpFileSystem struct {
+	mounts []*sftpMount // Longest path first
+	home   string       // Start directory of unconfined clients
+}
+
+func newSFTPFileSystem(root string, allowedPaths []string) (*sftpFileSystem, error) {
+	if root == "" {
+		root = "/"
+	}
+
+	base, err := os.OpenRoot(root)
+	if err != nil {
+		return nil, err
+	}
+
+	fs := &sftpFileSystem{}
+	if len(allowedPaths) == 0 {
+		fs.mounts = append(fs.mounts, &sftpMount{path: "/", root: base})
+		if root == "/" {
+			fs.home, _ = os.Getwd()
+		}
+		return fs, nil
+	}
+	defer base.Close()
+
+	for _, p := range allowedPaths {
+		p = path.Clean("/" + p)
+		rel := strings.TrimPrefix(p, "/")
+		if rel == "" {
+			rel = "."
+		}
+
+		r, err := base.OpenRoot(rel)
+		if err != nil {
+			fs.Close()
+			return nil, fmt.Errorf("allowed path %s: %w", p, err)
+		}
+
+		fs.mounts = append(fs.mounts, &sftpMount{path: p, root: r})
+	}
+
+	sort.Slice(fs.mounts, func(i, j int) bool {
+		return len(fs.mounts[i].path) > len(fs.mounts[j].path)
+	})
+
+	return fs, nil
+}
+
+func (fs *sftpFileSystem) Close() {
+	for _, m := range fs.mounts {
+		_ = m.root.Close()
+	}
+}
+
+func (fs *sftpFileSystem) startDirectory() string {
+	if fs.home != "" {
+		return fs.home
+	}
+
+	return fs.mounts[len(fs.mounts)-1].path
+}
+
+// resolve maps an absolute SFTP path to its mount and the path relative to the mount.
+func (fs *sftpFileSystem) resolve(p string) (*sftpMount, string, error) {
+	p = path.Clean("/" + p)
+	for _, m := range fs.mounts {
+		if m.path == "/" {
+			return m, "." + p, nil
+		}
+
+		if p == m.path {
+			return m, ".", nil
+		}
+
+		if strings.HasPrefix(p, m.path+"/") {
+			return m, strings.TrimPrefix(p, m.path+"/"), nil
+		}
+	}
+
+	return nil, "", os.ErrPermission
+}
+
+// resolvePair resolves the two paths of a rename or link, which must be on the same mount.
+func (fs *sftpFileSystem) resolvePair(from, to string) (*os.Root, string, string, error) {
+	m, fromRel, err := fs.resolve(from)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	toMount, toRel, err := fs.resolve(to)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	if toMount != m {
+		return nil, "", "", syscall.EXDEV
+	}
+
+	return m.root, fromRel, toRel, nil
+}
+
+func (fs *sftpFileSystem) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	m, rel, err := fs.resolve(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.root.Open(rel)
+}
+
+func (fs *sftpFileSystem) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	return fs.OpenFile(r)
+}
+
+func (fs *sftpFileSystem) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	m, rel, err := fs.resolve(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	// O_APPEND is left out on purpose, writes come with explicit offsets
+	pflags := r.Pflags()
+	flags := os.O_WRONLY
+	if pflags.Read {
+		flags = os.O_RDWR
+	}
+	if pflags.Creat {
+		flags |= os.O_CREATE
+	}
+	if pflags.Trunc {
+		flags |= os.O_TRUNC
+	}
+	if pflags.Excl {
+		flags |= os.O_EXCL
+	}
+
+	perm := os.FileMode(0644)
+	if r.AttrFlags().Permissions {
+		perm = r.Attributes().FileMode().Perm()
+	}
+
+	return m.root.OpenFile(rel, flags, perm)
+}
+
+func (fs *sftpFileSystem) Filecmd(r *sftp.Request) error {
+	switch r.Method {
+	case "Setstat":
+		return fs.setstat(r)
+	case "Rename":
+		root, from, to, err := fs.resolvePair(r.Filepath, r.Target)
+		if err != nil {
+			return err
+		}
+
+		// SFTP renames do not replace existing files
+		if _, err = root.Lstat(to); err == nil {
+			return os.ErrExist
+		}
+
+		return root.Rename(from, to)
+	case "Rmdir", "Remove":
+		m, rel, err := fs.resolve(r.Filepath)
+		if err != nil {
+			return err
+		}
+
+		info, err := m.root.Lstat(rel)
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() != (r.Method == "Rmdir") {
+			return sftp.ErrSSHFxFailure
+		}
+
+		return m.root.Remove(rel)
+	case "Mkdir":
+		m, rel, err := fs.resolve(r.Filepath)
+		if err != nil {
+			return err
+		}
+
+		return m.root.Mkdir(rel, 0755)
+	case "Link":
+		root, from, to, err := fs.resolvePair(r.Filepath, r.Target)
+		if err != nil {
+			return err
+		}
+
+		return root.Link(from, to)
+	case "Symlink":
+		// Filepath is the link target, it is stored as is
+		m, rel, err := fs.resolve(r.Target)
+		if err != nil {
+			return err
+		}
+
+		return m.root.Symlink(r.Filepath, rel)
+	}
+
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+// PosixRename replaces the target, unlike Rename.
+func (fs *sftpFileSystem) PosixRename(r *sftp.Request) error {
+	root, from, to, err := fs.resolvePair(r.Filepath, r.Target)
+	if err != nil {
+		return err
+	}
+
+	return root.Rename(from, to)
+}
+
+func (fs *sftpFileSystem) setstat(r *sftp.Request) error {
+	m, rel, err := fs.resolve(r.Filepath)
+	if err != nil {
+		return err
+	}
+
+	flags := r.AttrFlags()
+	attrs := r.Attributes()
+
+	if flags.Size {
+		f, err := m.root.OpenFile(rel, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+
+		err = f.Truncate(int64(attrs.Size))
+		_ = f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if flags.Permissions {
+		if err = m.root.Chmod(rel, attrs.FileMode()); err != nil {
+			return err
+		}
+	}
+
+	if flags.UidGid {
+		if err = m.root.Chown(rel, int(attrs.UID), int(attrs.GID)); err != nil {
+			return err
+		}
+	}
+
+	if flags.Acmodtime {
+		if err = m.root.Chtimes(rel, attrs.AccessTime(), attrs.ModTime()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (fs *sftpFileSystem) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	m, rel, err := fs.resolve(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	switch r.Method {
+	case "List":
+		dir, err := m.root.Open(rel)
+		if err != nil {
+			return nil, err
+		}
+		defer dir.Close()
+
+		entries, err := dir.Readdir(-1)
+		if err != nil {
+			return nil, err
+		}
+
+		return sftpListerAt(entries), nil
+	case "Stat":
+		info, err := m.root.Stat(rel)
+		if err != nil {
+			return nil, err
+		}
+
+		return sftpListerAt{info}, nil
+	}
+
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+func (fs *sftpFileSystem) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	m, rel, err := fs.resolve(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := m.root.Lstat(rel)
+	if err != nil {
+		return nil, err
+	}
+
+	return sftpListerAt{info}, nil
+}
+
+func (fs *sftpFileSystem) Readlink(p string) (string, error) {
+	m, rel, err := fs.resolve(p)
+	if err != nil {
+		return "", err
+	}
+
+	return m.root.Readlink(rel)
+}
+
+type sftpListerAt []os.FileInfo
+
+func (l sftpListerAt) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+var _ interface {
+	sftp.OpenFileWriter
+	sftp.PosixRenameFileCmder
+	sftp.LstatFileLister
+	sftp.ReadlinkFileLister
+} = (*sftpFileSystem)(nil)
@@ -0,0 +1,112 @@
+package handler
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+// TestMain lets the test binary stand in for tessad when the SSH server starts its SFTP child process.
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == SFTPServerCommand {
+		os.Exit(runTestSFTPServer(os.Args[2:]))
+	}
+
+	os.Exit(m.Run())
+}
+
+type stringList []string
+
+func (l *stringList) String() string { return "" }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+func runTestSFTPServer(args []string) int {
+	flags := flag.NewFlagSet(SFTPServerCommand, flag.ContinueOnError)
+	root := flags.String("root", "", "")
+	var allowed stringList
+	flags.Var(&allowed, "allow", "")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if err := ServeSFTP(os.Stdin, os.Stdout, *root, allowed); err != nil {
+		return 1
+	}
+
+	return 0
+}
+
+func TestSFTPConfinedToAllowedPaths(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "pub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "secret.txt"), []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../secret.txt", filepath.Join(root, "pub", "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	ca := newTestCA(t)
+	h := startTestServer(t, ca, func(cfg *SSHServerConfig) {
+		cfg.SFTPRoot = root
+		cfg.SFTPAllowedPaths = []string{"/pub"}
+	})
+
+	login := currentUser(t)
+	client, err := dialTestServer(t, h, login, ca.sign(t, login, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sftpClient.Close()
+
+	if wd, _ := sftpClient.Getwd(); wd != "/pub" {
+		t.Errorf("start directory %q, want /pub", wd)
+	}
+
+	f, err := sftpClient.Create("/pub/config.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write([]byte("key: value\n")); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	data, err := os.ReadFile(filepath.Join(root, "pub", "config.yaml"))
+	if err != nil || string(data) != "key: value\n" {
+		t.Fatalf("uploaded file %q: %v", data, err)
+	}
+
+	entries, err := sftpClient.ReadDir("/pub")
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("listed %d entries: %v", len(entries), err)
+	}
+
+	for _, p := range []string{"/secret.txt", "/pub/../secret.txt", "/pub/escape"} {
+		if f, err := sftpClient.Open(p); err == nil {
+			if _, err = io.ReadAll(f); err == nil {
+				t.Errorf("read %s outside the allowed paths", p)
+			}
+			_ = f.Close()
+		}
+	}
+
+	if err = sftpClient.Mkdir("/outside"); err == nil {
+		t.Error("created a directory outside the allowed paths")
+	}
+}
@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/gliderlabs/ssh"
+)
+
+const extensionPermitAgentForwarding = "permit-agent-forwarding"
+
+// startAgentForwarding serves the client's agent on a socket the login user can use, when the client
+// asked for it and both the device policy and the certificate permit it. It returns the socket
+// path for SSH_AUTH_SOCK, or "" without forwarding, and a function removing the socket, which is
+// also removed when the connection closes.
+func (h *SSHServerHandler) startAgentForwarding(s ssh.Session, u *loginUser) (string, func(), error) {
+	if !ssh.AgentRequested(s) {
+		return "", func() {}, nil
+	}
+
+	deny := func(reason string) (string, func(), error) {
+		slog.Warn(fmt.Sprintf("Denied agent forwarding: %s", reason), "key_id", contextKeyID(s.Context()), "user", s.User())
+		return "", func() {}, nil
+	}
+
+	if !h.allowAgentForwarding {
+		return deny("disabled on this device")
+	}
+
+	if !permitExtension(s.Context(), extensionPermitAgentForwarding) {
+		return deny("certificate does not permit agent forwarding")
+	}
+
+	l, err := ssh.NewAgentListener()
+	if err != nil {
+		return "", nil, err
+	}
+
+	sock := l.Addr().String()
+	dir := filepath.Dir(sock)
+
+	var once sync.Once
+	cleanup := func() {
+		once.Do(func() {
+			_ = l.Close()
+			_ = os.RemoveAll(dir)
+		})
+	}
+
+	// The socket directory is private to the login user
+	if u.credential != nil {
+		for _, p := range []string{dir, sock} {
+			if err = os.Chown(p, int(u.credential.Uid), int(u.credential.Gid)); err != nil {
+				cleanup()
+				return "", nil, err
+			}
+		}
+	}
+
+	go ssh.ForwardAgentConnections(l, s)
+	go func() {
+		<-s.Context().Done()
+		cleanup()
+	}()
+
+	slog.Info("Agent forwarding", "key_id", contextKeyID(s.Context()), "user", s.User())
+	return sock, cleanup, nil
+}
@@ -0,0 +1,96 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"os/exec"
+	"strings"
+	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// runWithAgent runs command in a session that asked for agent forwarding to keyring.
+func runWithAgent(t *testing.T, client *gossh.Client, keyring agent.Agent, command string) string {
+	t.Helper()
+
+	if err := agent.ForwardToAgent(client, keyring); err != nil {
+		t.Fatal(err)
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	if err = agent.RequestAgentForwarding(session); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout bytes.Buffer
+	session.Stdout = &stdout
+	_ = session.Run(command)
+
+	return stdout.String()
+}
+
+func TestSSHServerAgentForwarding(t *testing.T) {
+	if _, err := exec.LookPath("ssh-add"); err != nil {
+		t.Skip("ssh-add not installed")
+	}
+
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err = keyring.Add(agent.AddedKey{PrivateKey: private, Comment: "forwarded-key"}); err != nil {
+		t.Fatal(err)
+	}
+
+	ca := newTestCA(t)
+	h := startTestServer(t, ca, func(cfg *SSHServerConfig) {
+		cfg.AllowAgentForwarding = true
+	})
+
+	login := currentUser(t)
+	permitted := ca.sign(t, login, func(cert *gossh.Certificate) {
+		cert.Permissions.Extensions[extensionPermitAgentForwarding] = ""
+	})
+
+	client, err := dialTestServer(t, h, login, permitted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := runWithAgent(t, client, keyring, "ssh-add -l"); !strings.Contains(out, "forwarded-key") {
+		t.Fatalf("ssh-add -l = %q, want the forwarded key", out)
+	}
+
+	restricted, err := dialTestServer(t, h, login, ca.sign(t, login, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := runWithAgent(t, restricted, keyring, `echo "[$SSH_AUTH_SOCK]"`); out != "[]\n" {
+		t.Errorf("forwarded the agent without the permit-agent-forwarding extension: %q", out)
+	}
+}
+
+func TestSSHServerAgentForwardingDisabled(t *testing.T) {
+	ca := newTestCA(t)
+	h := startTestServer(t, ca, nil)
+
+	login := currentUser(t)
+	client, err := dialTestServer(t, h, login, ca.sign(t, login, func(cert *gossh.Certificate) {
+		cert.Permissions.Extensions[extensionPermitAgentForwarding] = ""
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out := runWithAgent(t, client, agent.NewKeyring(), `echo "[$SSH_AUTH_SOCK]"`); out != "[]\n" {
+		t.Errorf("forwarded the agent when the device does not allow it: %q", out)
+	}
+}
@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Certificate critical options and extensions honoured by the SSH server, see PROTOCOL.certkeys of OpenSSH.
+const (
+	optionForceCommand  = "force-command"
+	optionSourceAddress = "source-address"
+
+	extensionPermitPty = "permit-pty"
+
+	// internalSFTP as forced command restricts a certificate to SFTP, like in OpenSSH.
+	internalSFTP = "internal-sftp"
+)
+
+// supportedCriticalOptions are enforced by the server. Certificates with any other critical option are rejected.
+var supportedCriticalOptions = []string{optionForceCommand, optionSourceAddress}
+
+// checkSourceAddress verifies the client address against the comma-separated CIDR list of a
+// certificate's source-address option.
+func checkSourceAddress(addr net.Addr, sourceAddresses string) error {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("ssh: source-address: unsupported address type %T", addr)
+	}
+
+	for _, source := range strings.Split(sourceAddresses, ",") {
+		source = strings.TrimSpace(source)
+		if ip := net.ParseIP(source); ip != nil {
+			if ip.Equal(tcpAddr.IP) {
+				return nil
+			}
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(source)
+		if err != nil {
+			return fmt.Errorf("ssh: source-address: invalid address %q: %w", source, err)
+		}
+
+		if ipNet.Contains(tcpAddr.IP) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("ssh: source address %s is not allowed by the certificate", tcpAddr.IP)
+}
+
+// forceCommand returns the command the certificate forces instead of the requested one, or "".
+func forceCommand(ctx ssh.Context) string {
+	cert := contextCert(ctx)
+	if cert == nil {
+		return ""
+	}
+
+	return cert.CriticalOptions[optionForceCommand]
+}
+
+// permitExtension reports whether the connection's certificate carries an extension.
+func permitExtension(ctx ssh.Context, extension string) bool {
+	cert := contextCert(ctx)
+	if cert == nil {
+		return false
+	}
+
+	_, ok := cert.Permissions.Extensions[extension]
+	return ok
+}
+
+// permitPty refuses PTY requests of certificates without the permit-pty extension.
+func (h *SSHServerHandler) permitPty(ctx ssh.Context, _ ssh.Pty) bool {
+	return permitExtension(ctx, extensionPermitPty)
+}
+
+// newCertChecker returns a checker that only knows the critical options the server enforces.
+func newCertChecker() gossh.CertChecker {
+	return gossh.CertChecker{SupportedCriticalOptions: supportedCriticalOptions}
+}
@@ -0,0 +1,123 @@
+package handler
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestCheckSourceAddress(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 40000}
+
+	for sources, want := range map[string]bool{
+		"10.1.2.3":                   true,
+		"10.1.0.0/16":                true,
+		"192.168.0.0/16, 10.0.0.0/8": true,
+		"192.168.0.0/16":             false,
+		"not-an-address":             false,
+	} {
+		if got := checkSourceAddress(addr, sources) == nil; got != want {
+			t.Errorf("checkSourceAddress(%q) allowed %v, want %v", sources, got, want)
+		}
+	}
+}
+
+func TestSSHServerForceCommand(t *testing.T) {
+	ca := newTestCA(t)
+	h := startTestServer(t, ca, nil)
+
+	login := currentUser(t)
+	client, err := dialTestServer(t, h, login, ca.sign(t, login, func(cert *gossh.Certificate) {
+		cert.CriticalOptions = map[string]string{optionForceCommand: `echo "forced: $SSH_ORIGINAL_COMMAND"`}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout, _, code := runTestCommand(t, client, "id")
+	if stdout != "forced: id\n" || code != 0 {
+		t.Fatalf("got %q, exit %d", stdout, code)
+	}
+}
+
+func TestSSHServerRejectsUnsupportedCriticalOption(t *testing.T) {
+	ca := newTestCA(t)
+	h := startTestServer(t, ca, nil)
+
+	login := currentUser(t)
+	_, err := dialTestServer(t, h, login, ca.sign(t, login, func(cert *gossh.Certificate) {
+		cert.CriticalOptions = map[string]string{"verify-required": ""}
+	}))
+	if err == nil {
+		t.Fatal("expected a certificate with an unknown critical option to be rejected")
+	}
+}
+
+func TestSSHServerPermitPty(t *testing.T) {
+	ca := newTestCA(t)
+	h := startTestServer(t, ca, nil)
+
+	login := currentUser(t)
+	client, err := dialTestServer(t, h, login, ca.sign(t, login, func(cert *gossh.Certificate) {
+		delete(cert.Permissions.Extensions, extensionPermitPty)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	if err = session.RequestPty("xterm", 24, 80, gossh.TerminalModes{}); err == nil {
+		t.Fatal("PTY granted without the permit-pty extension")
+	}
+}
+
+func TestSSHServerSourceAddressFromProxyHeader(t *testing.T) {
+	ca := newTestCA(t)
+	h := startTestServer(t, ca, nil)
+
+	login := currentUser(t)
+	signer := ca.sign(t, login, func(cert *gossh.Certificate) {
+		cert.CriticalOptions = map[string]string{optionSourceAddress: "203.0.113.0/24"}
+	})
+
+	dial := func(source string) error {
+		conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", h.ListenPort()), 5*time.Second)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		header := proxyproto.HeaderProxyFromAddrs(2, &net.TCPAddr{IP: net.ParseIP(source), Port: 50000}, conn.LocalAddr())
+		if _, err = header.WriteTo(conn); err != nil {
+			return err
+		}
+
+		c, chans, reqs, err := gossh.NewClientConn(conn, conn.RemoteAddr().String(), &gossh.ClientConfig{
+			User:            login,
+			Auth:            []gossh.AuthMethod{gossh.PublicKeys(signer)},
+			HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+		})
+		if err != nil {
+			return err
+		}
+
+		return gossh.NewClient(c, chans, reqs).Close()
+	}
+
+	if err := dial("203.0.113.7"); err != nil {
+		t.Fatalf("client in source-address rejected: %v", err)
+	}
+
+	if err := dial("198.51.100.7"); err == nil {
+		t.Fatal("client outside source-address accepted")
+	}
+}
@@ -0,0 +1,215 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const extensionPermitPortForwarding = "permit-port-forwarding"
+
+// certContextKey holds the user certificate of an authenticated connection.
+var certContextKey = &struct{ name string }{"user-certificate"}
+
+func contextCert(ctx ssh.Context) *gossh.Certificate {
+	cert, _ := ctx.Value(certContextKey).(*gossh.Certificate)
+	return cert
+}
+
+// contextKeyID returns the key ID of the connection's certificate, for audit logs.
+func contextKeyID(ctx ssh.Context) string {
+	if cert := contextCert(ctx); cert != nil {
+		return cert.KeyId
+	}
+
+	return ""
+}
+
+// validateForwardPattern checks a "host:port" destination pattern. The host may use * and ? wildcards,
+// the port is a number or *.
+func validateForwardPattern(pattern string) error {
+	host, port, err := net.SplitHostPort(pattern)
+	if err != nil {
+		return err
+	}
+
+	if _, err = path.Match(host, ""); err != nil {
+		return fmt.Errorf("invalid host pattern %q: %w", host, err)
+	}
+
+	if port != "*" {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("invalid port %q", port)
+		}
+	}
+
+	return nil
+}
+
+// isIPPattern reports whether a destination host pattern is an IP address or an IP glob such as
+// 192.168.1.*, rather than a host name. Host names have a letter and no colon.
+func isIPPattern(pattern string) bool {
+	return strings.Contains(pattern, ":") || !strings.ContainsFunc(pattern, unicode.IsLetter)
+}
+
+// matchForwardPattern returns the address of ips to dial for a forward to host:port, or nil if the
+// pattern does not allow it. IP patterns are matched against the resolved addresses, not the
+// requested host: * also matches dots, so 192.168.1.* would otherwise let in host names like
+// 192.168.1.1.10.0.0.5.nip.io that resolve anywhere. Host name patterns trust the DNS of the name.
+func matchForwardPattern(pattern, host string, ips []net.IP, port uint32) net.IP {
+	patternHost, patternPort, err := net.SplitHostPort(pattern)
+	if err != nil {
+		return nil
+	}
+
+	if patternPort != "*" && patternPort != strconv.FormatUint(uint64(port), 10) {
+		return nil
+	}
+
+	patternHost = strings.ToLower(patternHost)
+	if isIPPattern(patternHost) {
+		for _, ip := range ips {
+			if ok, _ := path.Match(patternHost, ip.String()); ok {
+				return ip
+			}
+		}
+
+		return nil
+	}
+
+	if ok, _ := path.Match(patternHost, strings.ToLower(host)); ok && len(ips) > 0 {
+		return ips[0]
+	}
+
+	return nil
+}
+
+// resolveHost returns the addresses of a forward destination, an IP literal is its own address.
+func resolveHost(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	return net.DefaultResolver.LookupIP(ctx, "ip", host)
+}
+
+// permitLocalForward allows direct-tcpip channels when the certificate permits port forwarding
+// and the destination is on the allow-list. It returns the address to dial: the destination is
+// resolved once, so the address checked is the address connected to whatever DNS answers later.
+func (h *SSHServerHandler) permitLocalForward(ctx ssh.Context, host string, port uint32) (string, bool) {
+	destination := net.JoinHostPort(host, strconv.FormatUint(uint64(port), 10))
+	deny := func(reason string) (string, bool) {
+		slog.Warn(fmt.Sprintf("Denied port forwarding: %s", reason),
+			"key_id", contextKeyID(ctx), "user", ctx.User(), "addr", ctx.RemoteAddr(), "destination", destination)
+		return "", false
+	}
+
+	if !permitExtension(ctx, extensionPermitPortForwarding) {
+		return deny("certificate does not permit port forwarding")
+	}
+
+	if len(h.forwardAllowed) == 0 {
+		return deny("destination not allowed")
+	}
+
+	ips, err := h.resolve(ctx, host)
+	if err != nil {
+		return deny(fmt.Sprintf("resolve destination: %v", err))
+	}
+
+	for _, pattern := range h.forwardAllowed {
+		if ip := matchForwardPattern(pattern, host, ips, port); ip != nil {
+			addr := net.JoinHostPort(ip.String(), strconv.FormatUint(uint64(port), 10))
+			slog.Info("Port forwarding", "key_id", contextKeyID(ctx), "user", ctx.User(), "destination", destination, "address", addr)
+			return addr, true
+		}
+	}
+
+	return deny("destination not allowed")
+}
+
+// handleDirectTCPIP serves ssh -L channels like ssh.DirectTCPIPHandler, but dials the address
+// permitLocalForward checked instead of resolving the destination again.
+func (h *SSHServerHandler) handleDirectTCPIP(_ *ssh.Server, _ *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+	var d struct {
+		DestAddr   string
+		DestPort   uint32
+		OriginAddr string
+		OriginPort uint32
+	}
+	if err := gossh.Unmarshal(newChan.ExtraData(), &d); err != nil {
+		_ = newChan.Reject(gossh.ConnectionFailed, "error parsing forward data: "+err.Error())
+		return
+	}
+
+	addr, ok := h.permitLocalForward(ctx, d.DestAddr, d.DestPort)
+	if !ok {
+		_ = newChan.Reject(gossh.Prohibited, "port forwarding is disabled")
+		return
+	}
+
+	var dialer net.Dialer
+	dconn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		_ = newChan.Reject(gossh.ConnectionFailed, err.Error())
+		return
+	}
+
+	ch, reqs, err := newChan.Accept()
+	if err != nil {
+		_ = dconn.Close()
+		return
+	}
+	go gossh.DiscardRequests(reqs)
+
+	go func() {
+		defer ch.Close()
+		defer dconn.Close()
+		_, _ = io.Copy(ch, dconn)
+	}()
+	go func() {
+		defer ch.Close()
+		defer dconn.Close()
+		_, _ = io.Copy(dconn, ch)
+	}()
+}
+
+// permitRemoteForward allows ssh -R listeners when the device policy and the certificate permit
+// port forwarding. Listeners are bound to loopback only, and to unprivileged ports unless the login
+// user is root, like OpenSSH without GatewayPorts. They are closed with the connection.
+func (h *SSHServerHandler) permitRemoteForward(ctx ssh.Context, host string, port uint32) bool {
+	bind := net.JoinHostPort(host, strconv.FormatUint(uint64(port), 10))
+	deny := func(reason string) bool {
+		slog.Warn(fmt.Sprintf("Denied remote port forwarding: %s", reason),
+			"key_id", contextKeyID(ctx), "user", ctx.User(), "addr", ctx.RemoteAddr(), "bind", bind)
+		return false
+	}
+
+	if !h.allowRemoteForwarding {
+		return deny("disabled on this device")
+	}
+
+	if !permitExtension(ctx, extensionPermitPortForwarding) {
+		return deny("certificate does not permit port forwarding")
+	}
+
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return deny("only loopback addresses can be bound")
+	}
+
+	if u := contextLoginUser(ctx); port != 0 && port < 1024 && (u == nil || u.Uid != "0") {
+		return deny("privileged port")
+	}
+
+	slog.Info("Remote port forwarding", "key_id", contextKeyID(ctx), "user", ctx.User(), "bind", bind)
+	return true
+}
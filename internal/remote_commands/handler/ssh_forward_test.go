@@ -0,0 +1,289 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestMatchForwardPattern(t *testing.T) {
+	ips := func(addrs ...string) []net.IP {
+		parsed := make([]net.IP, 0, len(addrs))
+		for _, addr := range addrs {
+			parsed = append(parsed, net.ParseIP(addr))
+		}
+		return parsed
+	}
+
+	tests := []struct {
+		pattern string
+		host    string
+		ips     []net.IP
+		port    uint32
+		want    string
+	}{
+		{"127.0.0.1:8080", "127.0.0.1", ips("127.0.0.1"), 8080, "127.0.0.1"},
+		{"127.0.0.1:8080", "127.0.0.1", ips("127.0.0.1"), 8081, ""},
+		{"192.168.1.*:502", "192.168.1.20", ips("192.168.1.20"), 502, "192.168.1.20"},
+		{"192.168.1.*:502", "192.168.2.20", ips("192.168.2.20"), 502, ""},
+		// A host name dressed up as an allowed IP is matched by what it resolves to
+		{"192.168.1.*:502", "192.168.1.1.10.0.0.5.nip.io", ips("10.0.0.5"), 502, ""},
+		{"192.168.1.*:502", "plc.example", ips("10.0.0.5", "192.168.1.7"), 502, "192.168.1.7"},
+		{"localhost:*", "LOCALHOST", ips("127.0.0.1"), 22, "127.0.0.1"},
+		{"localhost:*", "127.0.0.1", ips("127.0.0.1"), 22, ""},
+		{"[::1]:80", "::1", ips("::1"), 80, "::1"},
+		{"*:80", "anything.example", ips("10.0.0.5"), 80, "10.0.0.5"},
+	}
+
+	for _, tt := range tests {
+		got := matchForwardPattern(tt.pattern, tt.host, tt.ips, tt.port)
+		if (got == nil && tt.want != "") || (got != nil && got.String() != tt.want) {
+			t.Errorf("matchForwardPattern(%q, %q, %v, %d) = %v, want %q", tt.pattern, tt.host, tt.ips, tt.port, got, tt.want)
+		}
+	}
+}
+
+// fakeResolver answers host lookups from a list of answers per host, the last one repeating.
+type fakeResolver struct {
+	mu      sync.Mutex
+	answers map[string][]string
+	lookups map[string]int
+}
+
+func (r *fakeResolver) resolve(_ context.Context, host string) ([]net.IP, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	answers, ok := r.answers[host]
+	if !ok {
+		return resolveHost(context.Background(), host)
+	}
+
+	n := r.lookups[host]
+	r.lookups[host]++
+	return []net.IP{net.ParseIP(answers[min(n, len(answers)-1)])}, nil
+}
+
+func (r *fakeResolver) count(host string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.lookups[host]
+}
+
+func TestSSHServerForwardDialsCheckedAddress(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte("hello"))
+			_ = conn.Close()
+		}
+	}()
+	port := backend.Addr().(*net.TCPAddr).Port
+
+	resolver := &fakeResolver{
+		answers: map[string][]string{
+			"127.0.0.1.10.0.0.5.nip.io": {"10.0.0.5"},
+			// Rebinding: the first answer is checked, later ones must not be dialled
+			"rebind.example":  {"127.0.0.1", "10.0.0.5"},
+			"rebind2.example": {"10.0.0.5", "127.0.0.1"},
+		},
+		lookups: make(map[string]int),
+	}
+
+	ca := newTestCA(t)
+	cfg := &SSHServerConfig{UserPublicKey: ca.authorizedKey(), ForwardAllowed: []string{fmt.Sprintf("127.0.0.*:%d", port)}}
+	h, err := NewSSHServerHandler(cfg, SSHServerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.resolve = resolver.resolve
+	go func() {
+		_ = h.Handle(context.Background())
+	}()
+	t.Cleanup(func() { _ = h.Stop() })
+
+	login := currentUser(t)
+	client, err := dialTestServer(t, h, login, ca.sign(t, login, func(cert *gossh.Certificate) {
+		cert.Permissions.Extensions[extensionPermitPortForwarding] = ""
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, host := range []string{"127.0.0.1.10.0.0.5.nip.io", "rebind2.example"} {
+		if conn, err := client.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port))); err == nil {
+			_ = conn.Close()
+			t.Errorf("forwarded to %s", host)
+		}
+	}
+
+	conn, err := client.Dial("tcp", net.JoinHostPort("rebind.example", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(conn)
+	_ = conn.Close()
+	if string(data) != "hello" {
+		t.Fatalf("read %q through the forward", data)
+	}
+	if n := resolver.count("rebind.example"); n != 1 {
+		t.Errorf("destination resolved %d times, want once", n)
+	}
+}
+
+func TestSSHServerLocalForwarding(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte("hello"))
+			_ = conn.Close()
+		}
+	}()
+
+	ca := newTestCA(t)
+	h := startTestServer(t, ca, func(cfg *SSHServerConfig) {
+		cfg.ForwardAllowed = []string{fmt.Sprintf("127.0.0.1:%d", backend.Addr().(*net.TCPAddr).Port)}
+	})
+
+	login := currentUser(t)
+	permitted := ca.sign(t, login, func(cert *gossh.Certificate) {
+		cert.Permissions.Extensions[extensionPermitPortForwarding] = ""
+	})
+
+	client, err := dialTestServer(t, h, login, permitted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := client.Dial("tcp", backend.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(conn)
+	_ = conn.Close()
+	if string(data) != "hello" {
+		t.Fatalf("read %q through the forward", data)
+	}
+
+	if _, err = client.Dial("tcp", "127.0.0.1:1"); err == nil {
+		t.Error("forwarded to a destination that is not allowed")
+	}
+
+	restricted, err := dialTestServer(t, h, login, ca.sign(t, login, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = restricted.Dial("tcp", backend.Addr().String()); err == nil {
+		t.Error("forwarded without the permit-port-forwarding extension")
+	}
+}
+
+func TestSSHServerRemoteForwarding(t *testing.T) {
+	ca := newTestCA(t)
+	h := startTestServer(t, ca, func(cfg *SSHServerConfig) {
+		cfg.AllowRemoteForwarding = true
+	})
+
+	login := currentUser(t)
+	permitted := ca.sign(t, login, func(cert *gossh.Certificate) {
+		cert.Permissions.Extensions[extensionPermitPortForwarding] = ""
+	})
+
+	client, err := dialTestServer(t, h, login, permitted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := client.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte("hello"))
+		_ = conn.Close()
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(conn)
+	_ = conn.Close()
+	if string(data) != "hello" {
+		t.Fatalf("read %q through the remote forward", data)
+	}
+
+	if _, err = client.Listen("tcp", "0.0.0.0:0"); err == nil {
+		t.Error("listened on a non-loopback address")
+	}
+
+	// Closing the connection closes its listeners
+	addr := ln.Addr().String()
+	_ = client.Close()
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			break
+		}
+		_ = conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("remote forward still listening after the connection closed")
+		}
+	}
+
+	restricted, err := dialTestServer(t, h, login, ca.sign(t, login, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = restricted.Listen("tcp", "127.0.0.1:0"); err == nil {
+		t.Error("listened without the permit-port-forwarding extension")
+	}
+}
+
+func TestSSHServerRemoteForwardingDisabled(t *testing.T) {
+	ca := newTestCA(t)
+	h := startTestServer(t, ca, nil)
+
+	login := currentUser(t)
+	client, err := dialTestServer(t, h, login, ca.sign(t, login, func(cert *gossh.Certificate) {
+		cert.Permissions.Extensions[extensionPermitPortForwarding] = ""
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = client.Listen("tcp", "127.0.0.1:0"); err == nil {
+		t.Error("listened when the device does not allow remote forwarding")
+	}
+}
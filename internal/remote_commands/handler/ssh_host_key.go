@@ -0,0 +1,212 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const (
+	hostKeyFile         = "ssh_host_ecdsa_key"
+	hostCertificateFile = "ssh_host_ecdsa_key-cert.pub"
+)
+
+// HostKey is the SSH host key of the device, generated once and kept in the data dir so clients
+// see the same fingerprint every session. A host certificate signed by a CA lets clients trust
+// it with @cert-authority instead. It is safe for concurrent use.
+type HostKey struct {
+	dir    string
+	signer gossh.Signer
+
+	mu   sync.RWMutex
+	cert *gossh.Certificate
+}
+
+// LoadHostKey loads the host key and certificate from dir, generating the key on first use.
+// An empty dir gives an ephemeral key.
+func LoadHostKey(dir string) (*HostKey, error) {
+	k := &HostKey{dir: dir}
+	if dir == "" {
+		signer, err := generateHostKey()
+		if err != nil {
+			return nil, err
+		}
+		k.signer = signer
+		return k, nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	keyPath := filepath.Join(dir, hostKeyFile)
+	data, err := os.ReadFile(keyPath)
+	switch {
+	case os.IsNotExist(err):
+		if data, err = createHostKey(keyPath); err != nil {
+			return nil, errors.Wrap(err, "create host key")
+		}
+	case err != nil:
+		return nil, err
+	}
+
+	if k.signer, err = gossh.ParsePrivateKey(data); err != nil {
+		return nil, errors.Wrap(err, "parse host key")
+	}
+
+	data, err = os.ReadFile(filepath.Join(dir, hostCertificateFile))
+	if err == nil {
+		if k.cert, err = k.parseCertificate(data); err != nil {
+			slog.Warn(fmt.Sprintf("Ignoring host certificate: %v", err))
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// parseHostPrivateKey parses a PEM private key, or the base64 encoding of one which is easier
+// to pass around in JSON.
+func parseHostPrivateKey(key string) (gossh.Signer, error) {
+	key = strings.TrimSpace(key)
+	if strings.HasPrefix(key, "-----BEGIN") {
+		return gossh.ParsePrivateKey([]byte(key))
+	}
+
+	data, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return gossh.ParsePrivateKey(data)
+}
+
+func generateHostKey() (gossh.Signer, error) {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return gossh.NewSignerFromKey(private)
+}
+
+// createHostKey writes a new ECDSA key in OpenSSH format, with its public key next to it.
+func createHostKey(path string) ([]byte, error) {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := gossh.MarshalPrivateKey(private, "tessad host key")
+	if err != nil {
+		return nil, err
+	}
+
+	public, err := gossh.NewPublicKey(&private.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	data := pem.EncodeToMemory(block)
+	if err = os.WriteFile(path, data, 0600); err != nil {
+		return nil, err
+	}
+
+	if err = os.WriteFile(path+".pub", gossh.MarshalAuthorizedKey(public), 0644); err != nil {
+		return nil, err
+	}
+
+	slog.Info("Generated SSH host key", "fingerprint", gossh.FingerprintSHA256(public))
+	return data, nil
+}
+
+// PublicKey returns the public host key.
+func (k *HostKey) PublicKey() gossh.PublicKey {
+	return k.signer.PublicKey()
+}
+
+// Certificate returns the installed host certificate, or nil.
+func (k *HostKey) Certificate() *gossh.Certificate {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.cert
+}
+
+// Signers returns the host keys to offer clients, the certificate first when one is installed.
+func (k *HostKey) Signers() []gossh.Signer {
+	cert := k.Certificate()
+	if cert == nil {
+		return []gossh.Signer{k.signer}
+	}
+
+	certSigner, err := gossh.NewCertSigner(cert, k.signer)
+	if err != nil {
+		return []gossh.Signer{k.signer}
+	}
+
+	return []gossh.Signer{certSigner, k.signer}
+}
+
+// SetCertificate installs a host certificate in authorized_keys format. It must certify this
+// host key and still be valid.
+func (k *HostKey) SetCertificate(data []byte) error {
+	cert, err := k.parseCertificate(data)
+	if err != nil {
+		return err
+	}
+
+	if k.dir != "" {
+		path := filepath.Join(k.dir, hostCertificateFile)
+		tmp := path + ".tmp"
+		if err = os.WriteFile(tmp, gossh.MarshalAuthorizedKey(cert), 0644); err == nil {
+			err = os.Rename(tmp, path)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	k.mu.Lock()
+	k.cert = cert
+	k.mu.Unlock()
+
+	slog.Info("Installed SSH host certificate", "key_id", cert.KeyId, "serial", cert.Serial)
+	return nil
+}
+
+func (k *HostKey) parseCertificate(data []byte) (*gossh.Certificate, error) {
+	pub, _, _, _, err := gossh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("parse host certificate: %w", err)
+	}
+
+	cert, ok := pub.(*gossh.Certificate)
+	if !ok || cert.CertType != gossh.HostCert {
+		return nil, errors.New("not a host certificate")
+	}
+
+	if !bytes.Equal(cert.Key.Marshal(), k.signer.PublicKey().Marshal()) {
+		return nil, errors.New("host certificate is for another key")
+	}
+
+	if uint64(time.Now().Unix()) >= cert.ValidBefore {
+		return nil, errors.New("host certificate has expired")
+	}
+
+	return cert, nil
+}
@@ -0,0 +1,240 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// signHost issues a host certificate for key.
+func (ca *testCA) signHost(t *testing.T, key gossh.PublicKey) []byte {
+	t.Helper()
+
+	cert := &gossh.Certificate{
+		Key:             key,
+		CertType:        gossh.HostCert,
+		KeyId:           "device",
+		ValidPrincipals: []string{"127.0.0.1"},
+		ValidAfter:      uint64(time.Now().Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(time.Now().Add(time.Hour).Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, ca.signer); err != nil {
+		t.Fatal(err)
+	}
+
+	return gossh.MarshalAuthorizedKey(cert)
+}
+
+func TestHostKeyIsPersisted(t *testing.T) {
+	dir := t.TempDir()
+	first, err := LoadHostKey(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca := newTestCA(t)
+	if err = first.SetCertificate(ca.signHost(t, first.PublicKey())); err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := LoadHostKey(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(first.PublicKey().Marshal(), second.PublicKey().Marshal()) {
+		t.Fatal("host key changed after reloading")
+	}
+
+	if second.Certificate() == nil || len(second.Signers()) != 2 {
+		t.Fatal("host certificate was not reloaded")
+	}
+}
+
+func TestHostKeyRejectsInvalidCertificates(t *testing.T) {
+	hostKey, err := LoadHostKey("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := LoadHostKey("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca := newTestCA(t)
+	for name, data := range map[string][]byte{
+		"other key":    ca.signHost(t, other.PublicKey()),
+		"user cert":    gossh.MarshalAuthorizedKey(ca.sign(t, "root", nil).PublicKey()),
+		"plain key":    gossh.MarshalAuthorizedKey(hostKey.PublicKey()),
+		"invalid data": []byte("garbage"),
+	} {
+		if err := hostKey.SetCertificate(data); err == nil {
+			t.Errorf("%s: expected the certificate to be rejected", name)
+		}
+	}
+
+	if hostKey.Certificate() != nil {
+		t.Fatal("a rejected certificate was installed")
+	}
+}
+
+func TestSSHServerOffersHostCertificate(t *testing.T) {
+	hostKey, err := LoadHostKey(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca := newTestCA(t)
+	h := startTestServerWithOptions(t, ca, nil, SSHServerOptions{HostKey: hostKey, Version: "1.2.3-rc1"})
+
+	// Installed while the server runs
+	hostCA := newTestCA(t)
+	if err = hostKey.SetCertificate(hostCA.signHost(t, hostKey.PublicKey())); err != nil {
+		t.Fatal(err)
+	}
+
+	checker := &gossh.CertChecker{
+		IsHostAuthority: func(auth gossh.PublicKey, _ string) bool {
+			return bytes.Equal(auth.Marshal(), hostCA.signer.PublicKey().Marshal())
+		},
+	}
+
+	login := currentUser(t)
+	client, err := gossh.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", h.ListenPort()), &gossh.ClientConfig{
+		User: login,
+		Auth: []gossh.AuthMethod{gossh.PublicKeys(ca.sign(t, login, nil))},
+		HostKeyCallback: func(hostname string, remote net.Addr, key gossh.PublicKey) error {
+			return checker.CheckHostKey("127.0.0.1:22", remote, key)
+		},
+		HostKeyAlgorithms: []string{gossh.CertAlgoECDSA256v01},
+		Timeout:           5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if version := string(client.ServerVersion()); version != "SSH-2.0-Tessa_1.2.3_rc1" {
+		t.Fatalf("got server version %q", version)
+	}
+}
+
+// dialHostKey connects to h offering only algorithm and returns the host key the server presented.
+func dialHostKey(t *testing.T, h *SSHServerHandler, login string, signer gossh.Signer, algorithm string) gossh.PublicKey {
+	t.Helper()
+
+	var hostKey gossh.PublicKey
+	client, err := gossh.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", h.ListenPort()), &gossh.ClientConfig{
+		User: login,
+		Auth: []gossh.AuthMethod{gossh.PublicKeys(signer)},
+		HostKeyCallback: func(_ string, _ net.Addr, key gossh.PublicKey) error {
+			hostKey = key
+			return nil
+		},
+		HostKeyAlgorithms: []string{algorithm},
+		Timeout:           5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = client.Close()
+
+	return hostKey
+}
+
+func TestSSHServerReportsPayloadHostKey(t *testing.T) {
+	device, err := LoadHostKey("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca := newTestCA(t)
+	if err = device.SetCertificate(ca.signHost(t, device.PublicKey())); err != nil {
+		t.Fatal(err)
+	}
+
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := gossh.MarshalPrivateKey(private, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := startTestServerWithOptions(t, ca, func(cfg *SSHServerConfig) {
+		cfg.HostPrivateKey = string(pem.EncodeToMemory(block))
+	}, SSHServerOptions{HostKey: device})
+
+	payloadKey, err := gossh.NewPublicKey(&private.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := gossh.FingerprintSHA256(payloadKey)
+
+	output := h.Output().(*SSHServerOutput)
+	if output.HostKeyFingerprint != want {
+		t.Errorf("reported host key %s, want the payload key %s", output.HostKeyFingerprint, want)
+	}
+	if got := output.HostKeyFingerprints[gossh.KeyAlgoECDSA256]; got != want {
+		t.Errorf("reported %s key %s, want the payload key %s", gossh.KeyAlgoECDSA256, got, want)
+	}
+	if len(output.HostKeyFingerprints) != 1 {
+		t.Errorf("reported host keys %v, the device key and its certificate are replaced", output.HostKeyFingerprints)
+	}
+
+	// The fingerprint reported is the key clients are shown
+	login := currentUser(t)
+	if got := dialHostKey(t, h, login, ca.sign(t, login, nil), gossh.KeyAlgoECDSA256); gossh.FingerprintSHA256(got) != want {
+		t.Errorf("server presented %s, want the payload key %s", gossh.FingerprintSHA256(got), want)
+	}
+}
+
+func TestSSHServerReportsDeviceHostKeys(t *testing.T) {
+	device, err := LoadHostKey("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca := newTestCA(t)
+	if err = device.SetCertificate(ca.signHost(t, device.PublicKey())); err != nil {
+		t.Fatal(err)
+	}
+
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := gossh.MarshalPrivateKey(private, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A payload key of another type is offered next to the device key
+	h := startTestServerWithOptions(t, ca, func(cfg *SSHServerConfig) {
+		cfg.HostPrivateKey = string(pem.EncodeToMemory(block))
+	}, SSHServerOptions{HostKey: device})
+
+	deviceFingerprint := gossh.FingerprintSHA256(device.PublicKey())
+	output := h.Output().(*SSHServerOutput)
+	if output.HostKeyFingerprints[gossh.KeyAlgoECDSA256] != deviceFingerprint ||
+		output.HostKeyFingerprints[gossh.CertAlgoECDSA256v01] != deviceFingerprint ||
+		output.HostKeyFingerprints[gossh.KeyAlgoED25519] != output.HostKeyFingerprint {
+		t.Errorf("reported host keys %v", output.HostKeyFingerprints)
+	}
+
+	login := currentUser(t)
+	if got := dialHostKey(t, h, login, ca.sign(t, login, nil), gossh.KeyAlgoECDSA256); gossh.FingerprintSHA256(got) != deviceFingerprint {
+		t.Errorf("server presented %s, want the device key %s", gossh.FingerprintSHA256(got), deviceFingerprint)
+	}
+}
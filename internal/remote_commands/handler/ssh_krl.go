@@ -0,0 +1,296 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/pkg/errors"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// OpenSSH key revocation list format, see PROTOCOL.krl in the OpenSSH sources.
+const (
+	krlMagic         = "SSHKRL\n\x00"
+	krlFormatVersion = 1
+
+	krlSectionCertificates      = 1
+	krlSectionExplicitKey       = 2
+	krlSectionFingerprintSHA1   = 3
+	krlSectionSignature         = 4
+	krlSectionFingerprintSHA256 = 5
+
+	krlSectionCertSerialList   = 0x20
+	krlSectionCertSerialRange  = 0x21
+	krlSectionCertSerialBitmap = 0x22
+	krlSectionCertKeyID        = 0x23
+)
+
+// KRL is a parsed OpenSSH key revocation list, as written by ssh-keygen -k. Signatures are not
+// verified, like sshd does for RevokedKeys.
+type KRL struct {
+	Version     uint64
+	GeneratedAt time.Time
+	Comment     string
+
+	certs  []*krlCerts
+	keys   map[string]struct{} // Revoked key blobs
+	sha1   map[string]struct{} // Revoked key blob fingerprints
+	sha256 map[string]struct{}
+}
+
+// krlCerts lists the revoked certificates of a CA, or of any CA when ca is nil.
+type krlCerts struct {
+	ca      []byte
+	serials map[uint64]struct{}
+	ranges  [][2]uint64
+	bitmaps []krlBitmap
+	keyIDs  map[string]struct{}
+}
+
+// krlBitmap revokes serial offset+n for each bit n set.
+type krlBitmap struct {
+	offset uint64
+	bits   *big.Int
+}
+
+// ParseKRL parses a binary OpenSSH KRL.
+func ParseKRL(data []byte) (*KRL, error) {
+	r := &krlReader{data: data}
+	if magic := r.bytes(len(krlMagic)); string(magic) != krlMagic {
+		return nil, errors.New("krl: bad magic")
+	}
+
+	if version := r.uint32(); r.err == nil && version != krlFormatVersion {
+		return nil, fmt.Errorf("krl: unsupported format version %d", version)
+	}
+
+	krl := &KRL{
+		Version:     r.uint64(),
+		GeneratedAt: time.Unix(int64(r.uint64()), 0).UTC(),
+		keys:        make(map[string]struct{}),
+		sha1:        make(map[string]struct{}),
+		sha256:      make(map[string]struct{}),
+	}
+	_ = r.uint64() // flags
+	_ = r.string() // reserved
+	krl.Comment = string(r.string())
+
+	for r.err == nil && r.len() > 0 {
+		sectionType := r.byte()
+		section := &krlReader{data: r.string()}
+		if r.err != nil {
+			break
+		}
+
+		switch sectionType {
+		case krlSectionCertificates:
+			certs, err := parseKRLCerts(section)
+			if err != nil {
+				return nil, err
+			}
+			krl.certs = append(krl.certs, certs)
+		case krlSectionExplicitKey:
+			section.strings(krl.keys)
+		case krlSectionFingerprintSHA1:
+			section.strings(krl.sha1)
+		case krlSectionFingerprintSHA256:
+			section.strings(krl.sha256)
+		case krlSectionSignature:
+			// Signatures come last and are not checked
+			return krl, r.err
+		default:
+			return nil, fmt.Errorf("krl: unsupported section type %d", sectionType)
+		}
+
+		if section.err != nil {
+			return nil, section.err
+		}
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	return krl, nil
+}
+
+func parseKRLCerts(r *krlReader) (*krlCerts, error) {
+	certs := &krlCerts{
+		serials: make(map[uint64]struct{}),
+		keyIDs:  make(map[string]struct{}),
+	}
+
+	if ca := r.string(); len(ca) > 0 {
+		key, err := gossh.ParsePublicKey(ca)
+		if err != nil {
+			return nil, fmt.Errorf("krl: parse CA key: %w", err)
+		}
+		certs.ca = key.Marshal()
+	}
+	_ = r.string() // reserved
+
+	for r.err == nil && r.len() > 0 {
+		sectionType := r.byte()
+		section := &krlReader{data: r.string()}
+		if r.err != nil {
+			break
+		}
+
+		switch sectionType {
+		case krlSectionCertSerialList:
+			for section.err == nil && section.len() > 0 {
+				certs.serials[section.uint64()] = struct{}{}
+			}
+		case krlSectionCertSerialRange:
+			certs.ranges = append(certs.ranges, [2]uint64{section.uint64(), section.uint64()})
+		case krlSectionCertSerialBitmap:
+			offset := section.uint64()
+			bits := new(big.Int).SetBytes(section.string())
+			certs.bitmaps = append(certs.bitmaps, krlBitmap{offset: offset, bits: bits})
+		case krlSectionCertKeyID:
+			section.strings(certs.keyIDs)
+		default:
+			return nil, fmt.Errorf("krl: unsupported certificate section type %d", sectionType)
+		}
+
+		if section.err != nil {
+			return nil, section.err
+		}
+	}
+
+	return certs, r.err
+}
+
+// IsRevoked reports whether the KRL revokes a certificate, its key or the CA that signed it.
+func (k *KRL) IsRevoked(cert *gossh.Certificate) bool {
+	if k.isKeyRevoked(cert.Key) || k.isKeyRevoked(cert.SignatureKey) {
+		return true
+	}
+
+	ca := cert.SignatureKey.Marshal()
+	for _, certs := range k.certs {
+		if certs.ca != nil && !bytes.Equal(certs.ca, ca) {
+			continue
+		}
+
+		if certs.isRevoked(cert) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (k *KRL) isKeyRevoked(key gossh.PublicKey) bool {
+	blob := key.Marshal()
+	if _, ok := k.keys[string(blob)]; ok {
+		return true
+	}
+
+	sum1 := sha1.Sum(blob)
+	if _, ok := k.sha1[string(sum1[:])]; ok {
+		return true
+	}
+
+	sum256 := sha256.Sum256(blob)
+	_, ok := k.sha256[string(sum256[:])]
+	return ok
+}
+
+func (c *krlCerts) isRevoked(cert *gossh.Certificate) bool {
+	if _, ok := c.keyIDs[cert.KeyId]; ok {
+		return true
+	}
+
+	if _, ok := c.serials[cert.Serial]; ok {
+		return true
+	}
+
+	for _, r := range c.ranges {
+		if cert.Serial >= r[0] && cert.Serial <= r[1] {
+			return true
+		}
+	}
+
+	for _, b := range c.bitmaps {
+		if cert.Serial >= b.offset && cert.Serial-b.offset < uint64(b.bits.BitLen()) &&
+			b.bits.Bit(int(cert.Serial-b.offset)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// krlReader reads SSH wire format values, remembering the first error.
+type krlReader struct {
+	data []byte
+	err  error
+}
+
+func (r *krlReader) len() int {
+	return len(r.data)
+}
+
+func (r *krlReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+
+	if n < 0 || n > len(r.data) {
+		r.err = errors.New("krl: truncated data")
+		return nil
+	}
+
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *krlReader) byte() byte {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+
+	return 0
+}
+
+func (r *krlReader) uint32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+
+	return 0
+}
+
+func (r *krlReader) uint64() uint64 {
+	if b := r.bytes(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+
+	return 0
+}
+
+func (r *krlReader) string() []byte {
+	n := r.uint32()
+	if n > uint32(len(r.data)) {
+		if r.err == nil {
+			r.err = errors.New("krl: truncated data")
+		}
+		return nil
+	}
+
+	return r.bytes(int(n))
+}
+
+// strings adds the remaining strings of the section to set.
+func (r *krlReader) strings(set map[string]struct{}) {
+	for r.err == nil && r.len() > 0 {
+		set[string(r.string())] = struct{}{}
+	}
+}
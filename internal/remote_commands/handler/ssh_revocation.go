@@ -0,0 +1,125 @@
+package handler
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// RevocationConfig lists revoked user certificates.
+type RevocationConfig struct {
+	// KRL is a binary OpenSSH key revocation list (ssh-keygen -k), base64 encoded in JSON.
+	KRL     []byte   `json:"krl,omitempty"`
+	Serials []uint64 `json:"serials,omitempty"`
+	KeyIDs  []string `json:"key_ids,omitempty"`
+}
+
+func (c *RevocationConfig) Validate() error {
+	if len(c.KRL) > 0 {
+		if _, err := ParseKRL(c.KRL); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RevocationList answers whether a certificate is revoked. It is safe for concurrent use and
+// can be replaced while SSH servers use it.
+type RevocationList struct {
+	mu      sync.RWMutex
+	krl     *KRL
+	serials map[uint64]struct{}
+	keyIDs  map[string]struct{}
+}
+
+// NewRevocationList builds a revocation list from cfg, which may be nil.
+func NewRevocationList(cfg *RevocationConfig) (*RevocationList, error) {
+	l := &RevocationList{}
+	if err := l.Update(cfg); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Update replaces the revoked certificates with those of cfg, which may be nil.
+func (l *RevocationList) Update(cfg *RevocationConfig) error {
+	var krl *KRL
+	serials := make(map[uint64]struct{})
+	keyIDs := make(map[string]struct{})
+
+	if cfg != nil {
+		if len(cfg.KRL) > 0 {
+			var err error
+			if krl, err = ParseKRL(cfg.KRL); err != nil {
+				return err
+			}
+		}
+
+		for _, serial := range cfg.Serials {
+			serials[serial] = struct{}{}
+		}
+
+		for _, keyID := range cfg.KeyIDs {
+			keyIDs[keyID] = struct{}{}
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.krl, l.serials, l.keyIDs = krl, serials, keyIDs
+
+	return nil
+}
+
+// IsRevoked reports whether cert is revoked. A nil list revokes nothing.
+func (l *RevocationList) IsRevoked(cert *gossh.Certificate) bool {
+	if l == nil {
+		return false
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if _, ok := l.serials[cert.Serial]; ok {
+		return true
+	}
+
+	if _, ok := l.keyIDs[cert.KeyId]; ok {
+		return true
+	}
+
+	return l.krl != nil && l.krl.IsRevoked(cert)
+}
+
+// isRevoked checks a certificate against the start-ssh payload and the device revocation lists.
+func (h *SSHServerHandler) isRevoked(cert *gossh.Certificate) bool {
+	return h.revoked.IsRevoked(cert) || h.deviceRevoked.IsRevoked(cert)
+}
+
+// DisconnectRevoked closes the connections authenticated with a certificate that is now revoked,
+// it returns how many were closed.
+func (h *SSHServerHandler) DisconnectRevoked() int {
+	h.mu.Lock()
+	revoked := make([]*sshConn, 0)
+	for ctx, c := range h.conns {
+		if cert := contextCert(ctx); cert != nil && h.isRevoked(cert) {
+			slog.Warn("Disconnecting revoked SSH certificate", "user", ctx.User(), "key_id", cert.KeyId, "serial", cert.Serial)
+			revoked = append(revoked, c)
+		}
+	}
+	h.mu.Unlock()
+
+	for _, c := range revoked {
+		_ = c.Close()
+	}
+
+	if len(revoked) > 0 {
+		slog.Info(fmt.Sprintf("Disconnected %d SSH connection(s) with revoked certificates", len(revoked)))
+	}
+
+	return len(revoked)
+}
@@ -0,0 +1,142 @@
+package handler
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestSSHServerRejectsRevokedCertificates(t *testing.T) {
+	ca := newTestCA(t)
+	device, err := NewRevocationList(&RevocationConfig{Serials: []uint64{7}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := startTestServerWithOptions(t, ca, func(cfg *SSHServerConfig) {
+		cfg.Revoked = &RevocationConfig{KeyIDs: []string{"leaver@example.com"}}
+	}, SSHServerOptions{Revocations: device})
+
+	login := currentUser(t)
+	for name, modify := range map[string]func(cert *gossh.Certificate){
+		"payload key id": func(cert *gossh.Certificate) { cert.KeyId = "leaver@example.com" },
+		"device serial":  func(cert *gossh.Certificate) { cert.Serial = 7 },
+	} {
+		if _, err := dialTestServer(t, h, login, ca.sign(t, login, modify)); err == nil {
+			t.Errorf("%s: expected the certificate to be rejected", name)
+		}
+	}
+
+	if _, err := dialTestServer(t, h, login, ca.sign(t, login, nil)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSSHServerDisconnectsRevokedCertificates(t *testing.T) {
+	ca := newTestCA(t)
+	device := &RevocationList{}
+	h := startTestServerWithOptions(t, ca, nil, SSHServerOptions{Revocations: device})
+
+	login := currentUser(t)
+	client, err := dialTestServer(t, h, login, ca.sign(t, login, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := h.DisconnectRevoked(); n != 0 {
+		t.Fatalf("disconnected %d connections before revocation", n)
+	}
+
+	if err = device.Update(&RevocationConfig{KeyIDs: []string{"test@example.com"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := h.DisconnectRevoked(); n != 1 {
+		t.Fatalf("disconnected %d connections, want 1", n)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- client.Wait() }()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("revoked connection was not closed")
+	}
+}
+
+func TestParseKRL(t *testing.T) {
+	keygen, err := exec.LookPath("ssh-keygen")
+	if err != nil {
+		t.Skip("ssh-keygen not found")
+	}
+
+	ca := newTestCA(t)
+	otherCA := newTestCA(t)
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pub")
+	specFile := filepath.Join(dir, "spec")
+	krlFile := filepath.Join(dir, "krl")
+
+	revokedKey := ca.sign(t, "root", nil).PublicKey().(*gossh.Certificate).Key
+	hashedKey := ca.sign(t, "root", nil).PublicKey().(*gossh.Certificate).Key
+	spec := "serial: 5\nserial: 100-200\nid: leaver@example.com\n"
+	if err = os.WriteFile(caFile, []byte(ca.authorizedKey()), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(specFile, []byte(spec+
+		"key: "+string(gossh.MarshalAuthorizedKey(revokedKey))+
+		"sha256: "+string(gossh.MarshalAuthorizedKey(hashedKey))), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if out, err := exec.Command(keygen, "-k", "-f", krlFile, "-s", caFile, "-z", "3", specFile).CombinedOutput(); err != nil {
+		t.Fatalf("ssh-keygen: %v: %s", err, out)
+	}
+
+	data, err := os.ReadFile(krlFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	krl, err := ParseKRL(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if krl.Version != 3 {
+		t.Fatalf("got KRL version %d", krl.Version)
+	}
+
+	cert := func(signer *testCA, serial uint64, keyID string) *gossh.Certificate {
+		return signer.sign(t, "root", func(cert *gossh.Certificate) {
+			cert.Serial, cert.KeyId = serial, keyID
+		}).PublicKey().(*gossh.Certificate)
+	}
+	revokedCert := cert(ca, 1, "someone@example.com")
+	revokedCert.Key = revokedKey
+	hashedCert := cert(ca, 1, "someone@example.com")
+	hashedCert.Key = hashedKey
+
+	for name, tc := range map[string]struct {
+		cert    *gossh.Certificate
+		revoked bool
+	}{
+		"serial":       {cert(ca, 5, "someone@example.com"), true},
+		"serial range": {cert(ca, 150, "someone@example.com"), true},
+		"key id":       {cert(ca, 1, "leaver@example.com"), true},
+		"key":          {revokedCert, true},
+		"valid":        {cert(ca, 6, "someone@example.com"), false},
+		"other CA":     {cert(otherCA, 5, "leaver@example.com"), false},
+	} {
+		if got := krl.IsRevoked(tc.cert); got != tc.revoked {
+			t.Errorf("%s: revoked %v, want %v", name, got, tc.revoked)
+		}
+	}
+
+	if _, err = ParseKRL(data[:len(data)-1]); err == nil {
+		t.Error("expected a truncated KRL to be rejected")
+	}
+}
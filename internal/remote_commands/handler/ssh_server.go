@@ -3,44 +3,145 @@ package handler
 import (
 	"bytes"
 	"context"
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
 	"fmt"
-	"io"
 	"log/slog"
 	"net"
-	"os"
-	"os/exec"
-	"syscall"
+	"path"
+	"strings"
+	"sync"
 	"time"
-	"unsafe"
 
-	"github.com/creack/pty"
 	"github.com/gliderlabs/ssh"
+	"github.com/pires/go-proxyproto"
 	"github.com/pkg/errors"
 	gossh "golang.org/x/crypto/ssh"
 )
 
 type SSHServerConfig struct {
-	UserPublicKey  string `json:"ca_public_key"`
+	UserPublicKey string `json:"ca_public_key"`
+	// HostPrivateKey replaces the device host key, PEM encoded or base64 of PEM.
 	HostPrivateKey string `json:"host_private_key,omitempty"`
+	// LANListen also accepts connections on this address, e.g. ":2222", for on-site technicians
+	// without the tunnel.
+	LANListen string `json:"lan_listen,omitempty"`
+	// SFTPRoot confines SFTP clients to a directory, which they see as "/".
+	SFTPRoot string `json:"sftp_root,omitempty"`
+	// SFTPAllowedPaths limits SFTP clients to these directories (inside SFTPRoot, if set).
+	SFTPAllowedPaths []string `json:"sftp_allowed_paths,omitempty"`
+	// ForwardAllowed lists the "host:port" destinations ssh -L may reach, e.g. "127.0.0.1:8080" or
+	// "192.168.1.*:502". IP patterns are matched against the resolved destination. Certificates also
+	// need the permit-port-forwarding extension.
+	ForwardAllowed []string `json:"forward_allowed,omitempty"`
+	// AllowAgentForwarding lets ssh -A clients use their agent in sessions. Certificates also need the
+	// permit-agent-forwarding extension.
+	AllowAgentForwarding bool `json:"allow_agent_forwarding,omitempty"`
+	// AllowRemoteForwarding lets ssh -R clients listen on the device loopback. Certificates also need
+	// the permit-port-forwarding extension.
+	AllowRemoteForwarding bool `json:"allow_remote_forwarding,omitempty"`
+	// AllowedUsers limits the local accounts SSH logins may use, empty allows every account.
+	AllowedUsers []string `json:"allowed_users,omitempty"`
+	// Record saves the terminal output of every session as an asciicast v2 file in the data dir.
+	Record bool `json:"record,omitempty"`
+	// RecordInput also records what clients type, which can include passwords.
+	RecordInput bool `json:"record_input,omitempty"`
+	// RecordingRetention caps the total size in bytes of the recordings kept on the device.
+	RecordingRetention int64 `json:"recording_retention,omitempty"`
+	// Revoked lists certificates refused by this server, on top of the device revocation list.
+	Revoked *RevocationConfig `json:"revoked,omitempty"`
+}
+
+// SSHServerOptions carries the device state an SSH server shares with the rest of the daemon.
+type SSHServerOptions struct {
+	// Recorder records sessions when set.
+	Recorder *Recorder
+	// Revocations is the device revocation list, updated over NATS while servers run.
+	Revocations *RevocationList
+	// HostKey is the device host key, an ephemeral key is used when it is nil.
+	HostKey *HostKey
+	// Version is the daemon version reported in the SSH banner.
+	Version string
+}
+
+type SSHServerOutput struct {
+	ListenPort int    `json:"listen_port"`
+	LANAddr    string `json:"lan_addr,omitempty"`
+	// HostKeyFingerprint is the payload host key when set, the device host key otherwise.
+	HostKeyFingerprint string `json:"host_key_fingerprint"`
+	// HostKeyFingerprints maps each host key algorithm offered to clients to the fingerprint of its key.
+	HostKeyFingerprints map[string]string   `json:"host_key_fingerprints"`
+	Sessions            []*SSHSessionOutput `json:"sessions"`
 }
 
 type SSHServerHandler struct {
 	TrustedUserPublicKey gossh.PublicKey
 	HostPrivateKey       gossh.Signer
+	hostKey              *HostKey
+	version              string
 
-	listener net.Listener
-	server   *ssh.Server
+	listener    net.Listener
+	listenPort  int
+	lanListener net.Listener // Direct LAN connections, nil unless lan_listen is set
+	server      *ssh.Server
+
+	sftpRoot         string
+	sftpAllowedPaths []string
+	forwardAllowed   []string
+	resolve          func(ctx context.Context, host string) ([]net.IP, error) // Resolves forward destinations
+	// allowAgentForwarding and allowRemoteForwarding are the device policy, certificates must
+	// permit them too
+	allowAgentForwarding  bool
+	allowRemoteForwarding bool
+	allowedUsers          []string
+	recorder              *Recorder
+	revoked               *RevocationList
+	deviceRevoked         *RevocationList
+
+	mu    sync.Mutex
+	conns map[ssh.Context]*sshConn // Open connections
 }
 
-func NewSSHServerHandler(payload interface{}) (*SSHServerHandler, error) {
-	req, err := JsonPayloadToConfig[SSHServerConfig](payload)
-	if err != nil {
-		return nil, errors.New("invalid payload type: expected SSHServerConfig")
+func (c *SSHServerConfig) Validate() error {
+	if c.UserPublicKey == "" {
+		return errors.New("ca_public_key is required")
 	}
 
+	if c.SFTPRoot != "" && !path.IsAbs(c.SFTPRoot) {
+		return errors.New("sftp_root must be an absolute path")
+	}
+
+	for _, p := range c.SFTPAllowedPaths {
+		if !path.IsAbs(p) {
+			return fmt.Errorf("sftp_allowed_paths: %s is not an absolute path", p)
+		}
+	}
+
+	if c.LANListen != "" {
+		if _, _, err := net.SplitHostPort(c.LANListen); err != nil {
+			return fmt.Errorf("lan_listen: %w", err)
+		}
+	}
+
+	if c.RecordingRetention < 0 {
+		return errors.New("recording_retention must not be negative")
+	}
+
+	if c.Revoked != nil {
+		if err := c.Revoked.Validate(); err != nil {
+			return fmt.Errorf("revoked: %w", err)
+		}
+	}
+
+	for _, p := range c.ForwardAllowed {
+		if err := validateForwardPattern(p); err != nil {
+			return fmt.Errorf("forward_allowed: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// NewSSHServerHandler builds the SSH server of a start-ssh command.
+func NewSSHServerHandler(req *SSHServerConfig, opts SSHServerOptions) (*SSHServerHandler, error) {
 	caPublicKey, _, _, _, err := gossh.ParseAuthorizedKey([]byte(req.UserPublicKey))
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse CA public key: %w", err)
@@ -48,61 +149,207 @@ func NewSSHServerHandler(payload interface{}) (*SSHServerHandler, error) {
 
 	var private gossh.Signer
 	if req.HostPrivateKey != "" {
-		private, err = gossh.ParsePrivateKey([]byte(req.HostPrivateKey))
+		private, err = parseHostPrivateKey(req.HostPrivateKey)
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse host private key: %w", err)
 		}
 	}
 
-	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	revoked, err := NewRevocationList(req.Revoked)
 	if err != nil {
 		return nil, err
 	}
 
-	return &SSHServerHandler{
-		TrustedUserPublicKey: caPublicKey,
-		HostPrivateKey:       private,
-		listener:             ln,
-	}, nil
+	hostKey := opts.HostKey
+	if hostKey == nil {
+		if hostKey, err = LoadHostKey(""); err != nil {
+			return nil, err
+		}
+	}
+
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	// Tunnel connections carry the client address in a PROXY protocol header, it is trusted
+	// from local peers only
+	ln := &proxyproto.Listener{
+		Listener: tcpListener,
+		Policy: func(upstream net.Addr) (proxyproto.Policy, error) {
+			if addr, ok := upstream.(*net.TCPAddr); ok && addr.IP.IsLoopback() {
+				return proxyproto.USE, nil
+			}
+			return proxyproto.IGNORE, nil
+		},
+	}
+
+	var lanListener net.Listener
+	if req.LANListen != "" {
+		if lanListener, err = net.Listen("tcp", req.LANListen); err != nil {
+			_ = ln.Close()
+			return nil, err
+		}
+	}
+
+	h := &SSHServerHandler{
+		TrustedUserPublicKey:  caPublicKey,
+		HostPrivateKey:        private,
+		hostKey:               hostKey,
+		version:               opts.Version,
+		listener:              ln,
+		listenPort:            tcpListener.Addr().(*net.TCPAddr).Port,
+		lanListener:           lanListener,
+		conns:                 make(map[ssh.Context]*sshConn),
+		sftpRoot:              req.SFTPRoot,
+		sftpAllowedPaths:      req.SFTPAllowedPaths,
+		forwardAllowed:        req.ForwardAllowed,
+		resolve:               resolveHost,
+		allowAgentForwarding:  req.AllowAgentForwarding,
+		allowRemoteForwarding: req.AllowRemoteForwarding,
+		allowedUsers:          req.AllowedUsers,
+		recorder:              opts.Recorder,
+		revoked:               revoked,
+		deviceRevoked:         opts.Revocations,
+	}
+
+	// The server is built up front so Stop never races with Handle
+	h.server = h.newServer()
+
+	return h, nil
 }
 
 func (h *SSHServerHandler) ListenPort() int {
-	addr := h.listener.Addr().(*net.TCPAddr)
-	return addr.Port
+	return h.listenPort
+}
+
+// ProxyProtocol asks the tunnel for PROXY protocol headers, so source-address can be checked
+// against the real client address.
+func (h *SSHServerHandler) ProxyProtocol() bool {
+	return true
 }
 
+func (h *SSHServerHandler) Output() interface{} {
+	output := &SSHServerOutput{
+		ListenPort:          h.listenPort,
+		HostKeyFingerprint:  gossh.FingerprintSHA256(h.hostKey.PublicKey()),
+		HostKeyFingerprints: make(map[string]string),
+		Sessions:            h.Sessions(),
+	}
+	if h.HostPrivateKey != nil {
+		output.HostKeyFingerprint = gossh.FingerprintSHA256(h.HostPrivateKey.PublicKey())
+	}
+	for _, signer := range h.hostSigners() {
+		output.HostKeyFingerprints[signer.PublicKey().Type()] = gossh.FingerprintSHA256(hostKeyOf(signer))
+	}
+	if h.lanListener != nil {
+		output.LANAddr = h.lanListener.Addr().String()
+	}
+
+	return output
+}
+
+// Handle serves the tunnel listener and, if set, the LAN listener until either fails or Stop is called.
 func (h *SSHServerHandler) Handle(ctx context.Context) error {
+	errs := make(chan error, 2)
+
 	slog.Info("Starting SSH server", slog.String("addr", fmt.Sprintf("127.0.0.1:%d", h.ListenPort())))
+	go func() {
+		errs <- h.server.Serve(h.listener)
+	}()
+
+	if h.lanListener != nil {
+		slog.Info("Accepting SSH connections from the LAN", slog.String("addr", h.lanListener.Addr().String()))
+		go func() {
+			errs <- h.server.Serve(h.lanListener)
+		}()
+	}
+
+	return <-errs
+}
+
+// serverVersion returns the SSH identification string, which may not contain spaces or dashes
+// after the protocol version.
+func (h *SSHServerHandler) serverVersion() string {
+	version := h.version
+	if version == "" {
+		version = "dev"
+	}
+
+	return "SSH-2.0-Tessa_" + strings.NewReplacer(" ", "_", "-", "_").Replace(version)
+}
 
+// serverConfig is built for every connection, so a host certificate installed while the
+// server runs is offered to new clients.
+func (h *SSHServerHandler) serverConfig() *gossh.ServerConfig {
 	config := &gossh.ServerConfig{
-		ServerVersion: fmt.Sprintf("SSH-2.0-%s_%s", "Tessa", "TODO: version"),
+		ServerVersion: h.serverVersion(),
 	}
 
-	// Setup host keys. Only accept ECDSA keys
-	if h.HostPrivateKey != nil {
-		config.AddHostKey(h.HostPrivateKey)
+	for _, signer := range h.hostSigners() {
+		config.AddHostKey(signer)
 	}
 
-	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-	if err != nil {
-		return err
+	return config
+}
+
+// hostSigners returns the host keys offered to clients. A host key from the payload replaces the
+// device key of the same type, and its certificate.
+func (h *SSHServerHandler) hostSigners() []gossh.Signer {
+	signers := h.hostKey.Signers()
+	if h.HostPrivateKey == nil {
+		return signers
+	}
+
+	offered := make([]gossh.Signer, 0, len(signers)+1)
+	for _, signer := range signers {
+		if hostKeyOf(signer).Type() != h.HostPrivateKey.PublicKey().Type() {
+			offered = append(offered, signer)
+		}
+	}
+
+	return append(offered, h.HostPrivateKey)
+}
+
+// hostKeyOf returns the public key of a host signer, the certified key for certificates.
+func hostKeyOf(signer gossh.Signer) gossh.PublicKey {
+	if cert, ok := signer.PublicKey().(*gossh.Certificate); ok {
+		return cert.Key
 	}
-	signer, _ := gossh.NewSignerFromKey(private)
-	config.AddHostKey(signer)
 
+	return signer.PublicKey()
+}
+
+func (h *SSHServerHandler) newServer() *ssh.Server {
 	certChecker := &UserCertChecker{
 		IsUserAuthority: func(auth gossh.PublicKey) bool {
 			return bytes.Equal(auth.Marshal(), h.TrustedUserPublicKey.Marshal())
 		},
-		certChecker: gossh.CertChecker{},
+		certChecker: newCertChecker(),
 	}
+	certChecker.certChecker.IsRevoked = h.isRevoked
 
-	// set default handler
-	ssh.Handle(h.handleSession)
+	// Remote forward listeners are closed when their connection ends
+	forwardHandler := &ssh.ForwardedTCPHandler{}
 
-	h.server = &ssh.Server{
+	return &ssh.Server{
+		Handler: h.handleSession,
+		SubsystemHandlers: map[string]ssh.SubsystemHandler{
+			"sftp": h.handleSFTP,
+		},
+		ChannelHandlers: map[string]ssh.ChannelHandler{
+			"session":      ssh.DefaultSessionHandler,
+			"direct-tcpip": h.handleDirectTCPIP,
+		},
+		RequestHandlers: map[string]ssh.RequestHandler{
+			"tcpip-forward":        forwardHandler.HandleSSHRequest,
+			"cancel-tcpip-forward": forwardHandler.HandleSSHRequest,
+		},
+		ConnCallback:                  h.trackConn,
+		ReversePortForwardingCallback: h.permitRemoteForward,
+		PtyCallback:                   h.permitPty,
 		ServerConfigCallback: func(ctx ssh.Context) *gossh.ServerConfig {
-			return config
+			return h.serverConfig()
 		},
 		PublicKeyHandler: func(ctx ssh.Context, pubKey ssh.PublicKey) bool {
 			remoteAddr := ctx.RemoteAddr()
@@ -113,48 +360,43 @@ func (h *SSHServerHandler) Handle(ctx context.Context) error {
 			}
 
 			ctx.SetValue(ssh.ContextKeyPermissions, &ssh.Permissions{Permissions: permissions})
+			cert := pubKey.(*gossh.Certificate)
+			if sourceAddresses, ok := cert.CriticalOptions[optionSourceAddress]; ok {
+				if err := checkSourceAddress(remoteAddr, sourceAddresses); err != nil {
+					slog.Warn(err.Error(), "addr", remoteAddr, "key_id", cert.KeyId)
+					return false
+				}
+			}
+
+			u, err := h.lookupLoginUser(ctx.User())
+			if err != nil {
+				slog.Warn(err.Error(), "addr", remoteAddr, "key_id", cert.KeyId)
+				return false
+			}
 
-			slog.Info("SSH connected", "addr", remoteAddr)
+			ctx.SetValue(certContextKey, cert)
+			ctx.SetValue(loginUserContextKey, u)
+
+			slog.Info("SSH connected", "addr", remoteAddr, "user", ctx.User(), "key_id", cert.KeyId)
 			return true
 		},
 		// close idle connections after 1 hour
 		IdleTimeout: 3600 * time.Second,
 	}
-
-	return h.server.Serve(h.listener)
 }
 
+// Stop closes the listeners and every open connection. The command warns open sessions and gives
+// them a grace period beforehand.
 func (h *SSHServerHandler) Stop() error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-	_ = h.listener.Close()
-	h.listener = nil
-	return h.server.Shutdown(ctx)
-}
-
-func (h *SSHServerHandler) handleSession(s ssh.Session) {
-	cmd := exec.Command("/bin/bash")
-	ptyReq, winCh, isPty := s.Pty()
-	if isPty {
-		cmd.Env = append(cmd.Env, fmt.Sprintf("TERM=%s", ptyReq.Term))
-		f, err := pty.Start(cmd)
-		if err != nil {
-			panic(err)
-		}
+	err := h.server.Close()
 
-		go func() {
-			for win := range winCh {
-				setWinsize(f, win.Width, win.Height)
-			}
-		}()
-		go func() {
-			io.Copy(f, s) // stdin
-		}()
-		io.Copy(s, f) // stdout
-		cmd.Wait()
+	// Listeners are only tracked by the server once served
+	_ = h.listener.Close()
+	if h.lanListener != nil {
+		_ = h.lanListener.Close()
 	}
 
-	s.Exit(0)
+	return err
 }
 
 type UserCertChecker struct {
@@ -181,8 +423,3 @@ func (c *UserCertChecker) Authenticate(user string, pubKey gossh.PublicKey) (*go
 
 	return &cert.Permissions, nil
 }
-
-func setWinsize(f *os.File, w, h int) {
-	syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), uintptr(syscall.TIOCSWINSZ),
-		uintptr(unsafe.Pointer(&struct{ h, w, x, y uint16 }{uint16(h), uint16(w), 0, 0})))
-}
@@ -0,0 +1,270 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os/user"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+type testCA struct {
+	signer gossh.Signer
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := gossh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCA{signer: signer}
+}
+
+func (ca *testCA) authorizedKey() string {
+	return string(gossh.MarshalAuthorizedKey(ca.signer.PublicKey()))
+}
+
+// sign issues a user certificate for principal, modify adjusts it before signing.
+func (ca *testCA) sign(t *testing.T, principal string, modify func(cert *gossh.Certificate)) gossh.Signer {
+	t.Helper()
+
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := gossh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert := &gossh.Certificate{
+		Key:             signer.PublicKey(),
+		CertType:        gossh.UserCert,
+		KeyId:           "test@example.com",
+		ValidPrincipals: []string{principal},
+		ValidAfter:      uint64(time.Now().Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(time.Now().Add(time.Hour).Unix()),
+		Permissions: gossh.Permissions{
+			Extensions: map[string]string{"permit-pty": ""},
+		},
+	}
+	if modify != nil {
+		modify(cert)
+	}
+
+	if err = cert.SignCert(rand.Reader, ca.signer); err != nil {
+		t.Fatal(err)
+	}
+
+	certSigner, err := gossh.NewCertSigner(cert, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return certSigner
+}
+
+func currentUser(t *testing.T) string {
+	t.Helper()
+
+	u, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return u.Username
+}
+
+// startTestServer runs an SSH server handler trusting ca until the test ends.
+func startTestServer(t *testing.T, ca *testCA, modify func(cfg *SSHServerConfig)) *SSHServerHandler {
+	t.Helper()
+
+	return startTestServerWithOptions(t, ca, modify, SSHServerOptions{})
+}
+
+// startTestServerWithOptions runs an SSH server handler trusting ca with device options.
+func startTestServerWithOptions(t *testing.T, ca *testCA, modify func(cfg *SSHServerConfig), opts SSHServerOptions) *SSHServerHandler {
+	t.Helper()
+
+	cfg := &SSHServerConfig{UserPublicKey: ca.authorizedKey()}
+	if modify != nil {
+		modify(cfg)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := NewSSHServerHandler(cfg, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		_ = h.Handle(context.Background())
+	}()
+	t.Cleanup(func() { _ = h.Stop() })
+
+	return h
+}
+
+func dialTestServer(t *testing.T, h *SSHServerHandler, login string, signer gossh.Signer) (*gossh.Client, error) {
+	t.Helper()
+
+	client, err := gossh.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", h.ListenPort()), &gossh.ClientConfig{
+		User:            login,
+		Auth:            []gossh.AuthMethod{gossh.PublicKeys(signer)},
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err == nil {
+		t.Cleanup(func() { _ = client.Close() })
+	}
+
+	return client, err
+}
+
+// runTestCommand runs command in a new non-PTY session and returns its output and exit status.
+func runTestCommand(t *testing.T, client *gossh.Client, command string) (string, string, int) {
+	t.Helper()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+
+	code := 0
+	if err = session.Run(command); err != nil {
+		var exitErr *gossh.ExitError
+		if !errors.As(err, &exitErr) {
+			t.Fatal(err)
+		}
+		code = exitErr.ExitStatus()
+	}
+
+	return stdout.String(), stderr.String(), code
+}
+
+func TestSSHServerExec(t *testing.T) {
+	ca := newTestCA(t)
+	h := startTestServer(t, ca, nil)
+
+	login := currentUser(t)
+	client, err := dialTestServer(t, h, login, ca.sign(t, login, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout, stderr, code := runTestCommand(t, client, "echo out; echo err >&2; exit 3")
+	if stdout != "out\n" || stderr != "err\n" || code != 3 {
+		t.Fatalf("got stdout %q, stderr %q, exit %d", stdout, stderr, code)
+	}
+}
+
+func TestSSHServerRejectsUntrustedCertificate(t *testing.T) {
+	h := startTestServer(t, newTestCA(t), nil)
+
+	login := currentUser(t)
+	if _, err := dialTestServer(t, h, login, newTestCA(t).sign(t, login, nil)); err == nil {
+		t.Fatal("expected a certificate from another CA to be rejected")
+	}
+}
+
+func TestSSHServerLANListener(t *testing.T) {
+	ca := newTestCA(t)
+	h := startTestServer(t, ca, func(cfg *SSHServerConfig) {
+		cfg.LANListen = "127.0.0.1:0"
+	})
+
+	output := h.Output().(*SSHServerOutput)
+	if output.LANAddr == "" {
+		t.Fatal("LAN address is not reported")
+	}
+
+	login := currentUser(t)
+	client, err := gossh.Dial("tcp", output.LANAddr, &gossh.ClientConfig{
+		User:            login,
+		Auth:            []gossh.AuthMethod{gossh.PublicKeys(ca.sign(t, login, nil))},
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if stdout, _, _ := runTestCommand(t, client, "echo lan"); stdout != "lan\n" {
+		t.Fatalf("got stdout %q", stdout)
+	}
+}
+
+func TestSSHServerStopClosesConnections(t *testing.T) {
+	ca := newTestCA(t)
+	h := startTestServer(t, ca, nil)
+
+	login := currentUser(t)
+	client, err := dialTestServer(t, h, login, ca.sign(t, login, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = h.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- client.Wait() }()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was left open")
+	}
+}
+
+func TestParseHostPrivateKey(t *testing.T) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, err := gossh.MarshalPrivateKey(private, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := pem.EncodeToMemory(block)
+	for name, key := range map[string]string{
+		"pem":    string(data),
+		"base64": base64.StdEncoding.EncodeToString(data),
+	} {
+		if _, err := parseHostPrivateKey(key); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	if _, err := parseHostPrivateKey("short"); err == nil {
+		t.Error("expected an invalid key to be rejected")
+	}
+}
@@ -0,0 +1,228 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/creack/pty"
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+)
+
+const defaultShell = "/bin/bash"
+
+// sshSignals maps SSH signal names to the signals delivered to the session process.
+var sshSignals = map[ssh.Signal]syscall.Signal{
+	ssh.SIGABRT: syscall.SIGABRT,
+	ssh.SIGALRM: syscall.SIGALRM,
+	ssh.SIGFPE:  syscall.SIGFPE,
+	ssh.SIGHUP:  syscall.SIGHUP,
+	ssh.SIGILL:  syscall.SIGILL,
+	ssh.SIGINT:  syscall.SIGINT,
+	ssh.SIGKILL: syscall.SIGKILL,
+	ssh.SIGPIPE: syscall.SIGPIPE,
+	ssh.SIGQUIT: syscall.SIGQUIT,
+	ssh.SIGSEGV: syscall.SIGSEGV,
+	ssh.SIGTERM: syscall.SIGTERM,
+	ssh.SIGUSR1: syscall.SIGUSR1,
+	ssh.SIGUSR2: syscall.SIGUSR2,
+}
+
+func (h *SSHServerHandler) handleSession(s ssh.Session) {
+	h.trackSession(s, true)
+	defer h.trackSession(s, false)
+
+	var rec *sessionRecording
+	if h.recorder != nil {
+		var err error
+		if rec, err = h.recorder.start(s); err != nil {
+			// Sessions are not allowed to go unrecorded
+			slog.Error(fmt.Sprintf("start session recording: %v", err), "user", s.User(), "addr", s.RemoteAddr())
+			_, _ = fmt.Fprint(s.Stderr(), "session recording is unavailable\r\n")
+			_ = s.Exit(1)
+			return
+		}
+	}
+
+	code, err := h.runSession(s, rec)
+	if err != nil {
+		slog.Warn(fmt.Sprintf("SSH session: %v", err), "user", s.User(), "addr", s.RemoteAddr())
+		_, _ = fmt.Fprintf(s.Stderr(), "%v\r\n", err)
+	}
+
+	_ = s.Exit(code)
+
+	if rec != nil {
+		h.recorder.finish(rec)
+	}
+}
+
+// runSession runs the requested command, or a shell when there is none, under a PTY if the
+// client asked for one, teeing the terminal into rec. It returns the exit status reported to the client.
+func (h *SSHServerHandler) runSession(s ssh.Session, rec *sessionRecording) (int, error) {
+	command := s.RawCommand()
+	forced := forceCommand(s.Context())
+	if forced == internalSFTP {
+		return 1, errors.New("this certificate only allows sftp")
+	}
+
+	if forced != "" {
+		command = forced
+	}
+
+	u := contextLoginUser(s.Context())
+	if u == nil {
+		return 1, errors.New("no login user")
+	}
+
+	cmd := u.command(command)
+	cmd.Env = append(cmd.Env, sessionEnv(s)...)
+	if forced != "" {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("SSH_ORIGINAL_COMMAND=%s", s.RawCommand()))
+	}
+
+	sock, stopAgent, err := h.startAgentForwarding(s, u)
+	if err != nil {
+		return 1, fmt.Errorf("agent forwarding: %w", err)
+	}
+	defer stopAgent()
+	if sock != "" {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("SSH_AUTH_SOCK=%s", sock))
+	}
+
+	ptyReq, winCh, isPty := s.Pty()
+	if isPty {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("TERM=%s", ptyReq.Term))
+		f, err := startPty(cmd, u, ptyReq.Window)
+		if err != nil {
+			return 1, err
+		}
+		defer f.Close()
+		h.setPty(s, ptyReq.Term, ptyReq.Window)
+
+		go func() {
+			for win := range winCh {
+				setWinsize(f, win.Width, win.Height)
+				h.setPty(s, ptyReq.Term, win)
+				rec.resize(win.Width, win.Height)
+			}
+		}()
+		go func() {
+			_, _ = io.Copy(io.MultiWriter(f, rec.input()), s) // stdin
+		}()
+		go forwardSignals(s, cmd.Process.Pid)
+
+		_, _ = io.Copy(io.MultiWriter(s, rec.output()), f) // stdout
+	} else {
+		// Own process group, so signals and disconnects reach every child of the command
+		cmd.SysProcAttr.Setpgid = true
+		cmd.Stdout = io.MultiWriter(s, rec.output())
+		cmd.Stderr = io.MultiWriter(s.Stderr(), rec.output())
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return 1, err
+		}
+
+		if err = cmd.Start(); err != nil {
+			return 1, err
+		}
+
+		go func() {
+			_, _ = io.Copy(io.MultiWriter(stdin, rec.input()), s)
+			_ = stdin.Close()
+		}()
+		go forwardSignals(s, cmd.Process.Pid)
+	}
+
+	_ = cmd.Wait()
+
+	return exitStatus(cmd.ProcessState), nil
+}
+
+// startPty starts a command in a new session with a PTY owned by the login user as controlling terminal.
+func startPty(cmd *exec.Cmd, u *loginUser, win ssh.Window) (*os.File, error) {
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer tty.Close()
+
+	if u.credential != nil {
+		if err = tty.Chown(int(u.credential.Uid), int(u.credential.Gid)); err != nil {
+			_ = ptmx.Close()
+			return nil, err
+		}
+	}
+
+	if err = pty.Setsize(ptmx, &pty.Winsize{Rows: uint16(win.Height), Cols: uint16(win.Width)}); err != nil {
+		_ = ptmx.Close()
+		return nil, err
+	}
+
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = tty, tty, tty
+	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Setctty = true
+	if err = cmd.Start(); err != nil {
+		_ = ptmx.Close()
+		return nil, err
+	}
+
+	return ptmx, nil
+}
+
+// forwardSignals delivers the signals sent by the client to the process group of the session
+// command, and hangs it up when the client goes away.
+func forwardSignals(s ssh.Session, pgid int) {
+	signals := make(chan ssh.Signal, 1)
+	s.Signals(signals)
+	defer s.Signals(nil)
+
+	for {
+		select {
+		case sig := <-signals:
+			if signal, ok := sshSignals[sig]; ok {
+				_ = syscall.Kill(-pgid, signal)
+			}
+		case <-s.Context().Done():
+			_ = syscall.Kill(-pgid, syscall.SIGHUP)
+			return
+		}
+	}
+}
+
+// exitStatus follows the shell convention of 128+n for commands killed by signal n.
+func exitStatus(state *os.ProcessState) int {
+	if state == nil {
+		return 1
+	}
+
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+
+	return state.ExitCode()
+}
+
+// sessionEnv returns the variables sent by the client that are passed to session commands,
+// only the locale like the default AcceptEnv of OpenSSH.
+func sessionEnv(s ssh.Session) []string {
+	env := make([]string, 0)
+	for _, kv := range s.Environ() {
+		if strings.HasPrefix(kv, "LANG=") || strings.HasPrefix(kv, "LC_") {
+			env = append(env, kv)
+		}
+	}
+
+	return env
+}
+
+func setWinsize(f *os.File, w, h int) {
+	syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), uintptr(syscall.TIOCSWINSZ),
+		uintptr(unsafe.Pointer(&struct{ h, w, x, y uint16 }{uint16(h), uint16(w), 0, 0})))
+}
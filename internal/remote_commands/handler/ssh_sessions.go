@@ -0,0 +1,237 @@
+package handler
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// sessionIDLength is how much of the SSH session identifier names a session in lists and kill requests.
+const sessionIDLength = 12
+
+// SSHSessionOutput describes a connected SSH client.
+type SSHSessionOutput struct {
+	ID         string        `json:"id"`
+	User       string        `json:"user"`
+	KeyID      string        `json:"key_id"`
+	RemoteAddr string        `json:"remote_addr"`
+	StartedAt  time.Time     `json:"started_at"`
+	Pty        *SSHPtyOutput `json:"pty,omitempty"`
+	// Channels counts the open shell, command and SFTP sessions of the connection.
+	Channels int   `json:"channels"`
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+}
+
+// SSHPtyOutput is the terminal of the latest PTY session of a connection.
+type SSHPtyOutput struct {
+	Term   string `json:"term"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// SSHSessionFilter selects sessions by ID, login user and certificate key ID. Empty fields
+// match every session.
+type SSHSessionFilter struct {
+	ID    string `json:"id,omitempty"`
+	User  string `json:"user,omitempty"`
+	KeyID string `json:"key_id,omitempty"`
+}
+
+// sshConn is a client connection, counting the bytes it transfers. Its fields other than the
+// counters are guarded by the handler mutex.
+type sshConn struct {
+	net.Conn
+	ctx       ssh.Context
+	startedAt time.Time
+	sessions  map[ssh.Session]struct{}
+	pty       *SSHPtyOutput
+
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+}
+
+func (c *sshConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.bytesIn.Add(int64(n))
+	return n, err
+}
+
+func (c *sshConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.bytesOut.Add(int64(n))
+	return n, err
+}
+
+// authenticated reports whether the client logged in, only then it has a session ID and user.
+func (c *sshConn) authenticated() bool {
+	return contextCert(c.ctx) != nil
+}
+
+func (c *sshConn) id() string {
+	return fmt.Sprintf("%.*s", sessionIDLength, c.ctx.SessionID())
+}
+
+func (f *SSHSessionFilter) match(c *sshConn) bool {
+	return (f.ID == "" || f.ID == c.id()) &&
+		(f.User == "" || f.User == c.ctx.User()) &&
+		(f.KeyID == "" || f.KeyID == contextKeyID(c.ctx))
+}
+
+// trackConn keeps the network connection of ctx until it closes, so it can be listed and cut off.
+func (h *SSHServerHandler) trackConn(ctx ssh.Context, conn net.Conn) net.Conn {
+	c := &sshConn{
+		Conn:      conn,
+		ctx:       ctx,
+		startedAt: time.Now().UTC(),
+		sessions:  make(map[ssh.Session]struct{}),
+	}
+
+	h.mu.Lock()
+	h.conns[ctx] = c
+	h.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		h.mu.Lock()
+		delete(h.conns, ctx)
+		h.mu.Unlock()
+	}()
+
+	return c
+}
+
+func (h *SSHServerHandler) trackSession(s ssh.Session, add bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	c, ok := h.conns[s.Context()]
+	if !ok {
+		return
+	}
+
+	if add {
+		c.sessions[s] = struct{}{}
+	} else {
+		delete(c.sessions, s)
+	}
+}
+
+// setPty records the terminal size of a PTY session.
+func (h *SSHServerHandler) setPty(s ssh.Session, term string, win ssh.Window) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if c, ok := h.conns[s.Context()]; ok {
+		c.pty = &SSHPtyOutput{Term: term, Width: win.Width, Height: win.Height}
+	}
+}
+
+// Sessions lists the logged in clients, oldest first.
+func (h *SSHServerHandler) Sessions() []*SSHSessionOutput {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sessions := make([]*SSHSessionOutput, 0, len(h.conns))
+	for _, c := range h.conns {
+		if !c.authenticated() {
+			continue
+		}
+
+		session := &SSHSessionOutput{
+			ID:         c.id(),
+			User:       c.ctx.User(),
+			KeyID:      contextKeyID(c.ctx),
+			RemoteAddr: c.ctx.RemoteAddr().String(),
+			StartedAt:  c.startedAt,
+			Channels:   len(c.sessions),
+			BytesIn:    c.bytesIn.Load(),
+			BytesOut:   c.bytesOut.Load(),
+		}
+		if c.pty != nil {
+			pty := *c.pty
+			session.Pty = &pty
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].StartedAt.Before(sessions[j].StartedAt)
+	})
+
+	return sessions
+}
+
+// Disconnect closes the sessions matching filter and returns how many there are. With a message,
+// it is first written to their terminals and the sessions are closed after delay.
+func (h *SSHServerHandler) Disconnect(filter SSHSessionFilter, message string, delay time.Duration) int {
+	h.mu.Lock()
+	matched := make([]*sshConn, 0)
+	sessions := make([]ssh.Session, 0)
+	for _, c := range h.conns {
+		if c.authenticated() && filter.match(c) {
+			matched = append(matched, c)
+			for s := range c.sessions {
+				sessions = append(sessions, s)
+			}
+		}
+	}
+	h.mu.Unlock()
+
+	if len(matched) == 0 {
+		return 0
+	}
+
+	if message == "" {
+		delay = 0
+	} else {
+		announce(sessions, message)
+	}
+
+	disconnect := func() {
+		for _, c := range matched {
+			slog.Info("Disconnecting SSH session", "id", c.id(), "user", c.ctx.User(), "key_id", contextKeyID(c.ctx))
+			_ = c.Close()
+		}
+	}
+
+	if delay > 0 {
+		time.AfterFunc(delay, disconnect)
+	} else {
+		disconnect()
+	}
+
+	return len(matched)
+}
+
+// Notify writes a message to the terminal of every open session.
+func (h *SSHServerHandler) Notify(message string) {
+	h.mu.Lock()
+	sessions := make([]ssh.Session, 0)
+	for _, c := range h.conns {
+		for s := range c.sessions {
+			sessions = append(sessions, s)
+		}
+	}
+	h.mu.Unlock()
+
+	if len(sessions) > 0 {
+		slog.Info(fmt.Sprintf("Announcing to %d active session(s)...", len(sessions)))
+	}
+
+	announce(sessions, message)
+}
+
+// announce writes a message to the terminal of sessions. Writes can block on a slow client, so
+// they must happen outside the handler lock.
+func announce(sessions []ssh.Session, message string) {
+	for _, s := range sessions {
+		_, _ = fmt.Fprintf(s.Stderr(), "\r\n\n%s\r\n", message)
+	}
+}
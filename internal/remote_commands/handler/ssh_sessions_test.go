@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSSHServerListsAndDisconnectsSessions(t *testing.T) {
+	ca := newTestCA(t)
+	h := startTestServer(t, ca, nil)
+
+	login := currentUser(t)
+	client, err := dialTestServer(t, h, login, ca.sign(t, login, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stdout, _, _ := runTestCommand(t, client, "echo hello"); stdout != "hello\n" {
+		t.Fatalf("got stdout %q", stdout)
+	}
+
+	sessions := h.Sessions()
+	if len(sessions) != 1 {
+		t.Fatalf("got %d sessions, want 1", len(sessions))
+	}
+
+	s := sessions[0]
+	if len(s.ID) != sessionIDLength || s.User != login || s.KeyID != "test@example.com" || s.BytesIn == 0 || s.BytesOut == 0 {
+		t.Fatalf("unexpected session %+v", s)
+	}
+
+	if n := h.Disconnect(SSHSessionFilter{KeyID: "someone-else"}, "", 0); n != 0 {
+		t.Fatalf("disconnected %d sessions of another key", n)
+	}
+
+	if n := h.Disconnect(SSHSessionFilter{ID: s.ID}, "maintenance", 0); n != 1 {
+		t.Fatalf("disconnected %d sessions, want 1", n)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- client.Wait() }()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session was not disconnected")
+	}
+}
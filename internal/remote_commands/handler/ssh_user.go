@@ -0,0 +1,102 @@
+package handler
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/gliderlabs/ssh"
+)
+
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// loginUserContextKey holds the local account of an authenticated connection.
+var loginUserContextKey = &struct{ name string }{"login-user"}
+
+// loginUser is the local account SSH sessions of a connection run as.
+type loginUser struct {
+	*user.User
+	credential *syscall.Credential // nil when the daemon already runs as the user
+	shell      string
+}
+
+func contextLoginUser(ctx ssh.Context) *loginUser {
+	u, _ := ctx.Value(loginUserContextKey).(*loginUser)
+	return u
+}
+
+// lookupLoginUser maps an SSH login name to a local account. Logins that are not in the
+// allow-list (when set) or have no local account are refused.
+func (h *SSHServerHandler) lookupLoginUser(name string) (*loginUser, error) {
+	if len(h.allowedUsers) > 0 && !slices.Contains(h.allowedUsers, name) {
+		return nil, fmt.Errorf("ssh: user %s is not allowed", name)
+	}
+
+	u, credential, err := lookupCredential(name)
+	if err != nil {
+		return nil, fmt.Errorf("ssh: unknown user %s: %w", name, err)
+	}
+
+	if os.Geteuid() != 0 {
+		if credential.Uid != uint32(os.Geteuid()) {
+			return nil, fmt.Errorf("ssh: cannot log in as %s, the daemon does not run as root", name)
+		}
+		credential = nil
+	}
+
+	return &loginUser{User: u, credential: credential, shell: loginShell(name)}, nil
+}
+
+// loginShell reads the shell of an account from /etc/passwd.
+func loginShell(name string) string {
+	f, err := os.Open("/etc/passwd")
+	if err != nil {
+		return defaultShell
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) == 7 && fields[0] == name && fields[6] != "" {
+			return fields[6]
+		}
+	}
+
+	return defaultShell
+}
+
+// env returns the base environment of the user's processes.
+func (u *loginUser) env() []string {
+	return []string{
+		fmt.Sprintf("PATH=%s", defaultPath),
+		fmt.Sprintf("HOME=%s", u.HomeDir),
+		fmt.Sprintf("USER=%s", u.Username),
+		fmt.Sprintf("LOGNAME=%s", u.Username),
+		fmt.Sprintf("SHELL=%s", u.shell),
+	}
+}
+
+// command runs a command line through the user's shell, or the shell as a login shell when
+// command is empty, in the user's home directory and with the user's credentials.
+func (u *loginUser) command(command string) *exec.Cmd {
+	cmd := exec.Command(u.shell)
+	if command != "" {
+		cmd.Args = append(cmd.Args, "-c", command)
+	} else {
+		// A leading dash makes the shell a login shell
+		cmd.Args[0] = "-" + filepath.Base(u.shell)
+	}
+
+	cmd.Dir = u.HomeDir
+	cmd.Env = u.env()
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: u.credential}
+
+	return cmd
+}
@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"os"
+	"os/user"
+	"strings"
+	"testing"
+)
+
+func TestLookupLoginUser(t *testing.T) {
+	login := currentUser(t)
+	h := &SSHServerHandler{}
+
+	u, err := h.lookupLoginUser(login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Username != login || u.shell == "" {
+		t.Errorf("looked up %+v", u)
+	}
+
+	if _, err = h.lookupLoginUser("no-such-user-tessa"); err == nil {
+		t.Error("expected an unknown user to be refused")
+	}
+
+	h.allowedUsers = []string{"someone-else"}
+	if _, err = h.lookupLoginUser(login); err == nil {
+		t.Error("expected a user outside the allow-list to be refused")
+	}
+}
+
+func TestLookupLoginUserDropsPrivileges(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root")
+	}
+
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("no nobody account")
+	}
+
+	u, err := (&SSHServerHandler{}).lookupLoginUser("nobody")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.credential == nil || u.credential.Uid == 0 || nobody.Uid == "0" {
+		t.Fatalf("credential %+v", u.credential)
+	}
+}
+
+func TestSSHServerSessionEnvironment(t *testing.T) {
+	ca := newTestCA(t)
+	h := startTestServer(t, ca, nil)
+
+	login := currentUser(t)
+	client, err := dialTestServer(t, h, login, ca.sign(t, login, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := user.Lookup(login)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout, _, _ := runTestCommand(t, client, `echo "$USER $HOME $(pwd)"`)
+	if want := strings.Join([]string{login, u.HomeDir, u.HomeDir}, " ") + "\n"; stdout != want {
+		t.Fatalf("got %q, want %q", stdout, want)
+	}
+}
+
+func TestSSHServerRefusesUserOutsideAllowList(t *testing.T) {
+	ca := newTestCA(t)
+	h := startTestServer(t, ca, func(cfg *SSHServerConfig) {
+		cfg.AllowedUsers = []string{"someone-else"}
+	})
+
+	login := currentUser(t)
+	if _, err := dialTestServer(t, h, login, ca.sign(t, login, nil)); err == nil {
+		t.Fatal("expected the login to be refused")
+	}
+}
@@ -0,0 +1,43 @@
+package handler
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// lookupCredential resolves a local account to the credential a child process runs with.
+func lookupCredential(name string) (*user.User, *syscall.Credential, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid uid %q: %w", u.Uid, err)
+	}
+
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid gid %q: %w", u.Gid, err)
+	}
+
+	credential := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+
+	groupIDs, err := u.GroupIds()
+	if err != nil {
+		return nil, nil, fmt.Errorf("groups of %s: %w", name, err)
+	}
+
+	for _, g := range groupIDs {
+		id, err := strconv.ParseUint(g, 10, 32)
+		if err != nil {
+			continue
+		}
+		credential.Groups = append(credential.Groups, uint32(id))
+	}
+
+	return u, credential, nil
+}
@@ -0,0 +1,131 @@
+package remote_commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Fyve-Labs/tessa-daemon/internal/remote_commands/handler"
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const (
+	// NatsHostKeySubject answers requests with the device SSH host key, for the control plane to
+	// certify it.
+	NatsHostKeySubject = "tessa.devices.%s.ssh.host_key"
+	// NatsHostCertSubject receives a host certificate for the device SSH host key.
+	NatsHostCertSubject = "tessa.devices.%s.ssh.host_certificate"
+)
+
+const sshDir = "ssh"
+
+// HostCertRequest installs a host certificate in authorized_keys format.
+type HostCertRequest struct {
+	Certificate string `json:"certificate"`
+}
+
+func (r *HostCertRequest) Validate() error {
+	if strings.TrimSpace(r.Certificate) == "" {
+		return errors.New("certificate is required")
+	}
+
+	return nil
+}
+
+// HostKeyInfo describes the device SSH host key and its certificate.
+type HostKeyInfo struct {
+	PublicKey            string     `json:"public_key,omitempty"`
+	Fingerprint          string     `json:"fingerprint,omitempty"`
+	Certificate          string     `json:"certificate,omitempty"`
+	CertificateExpiresAt *time.Time `json:"certificate_expires_at,omitempty"`
+	Error                string     `json:"error,omitempty"`
+	Time                 time.Time  `json:"time"`
+}
+
+// loadHostKey loads the device host key from the data dir, SSH servers use an ephemeral key
+// when it cannot be loaded.
+func (cm *CommandManager) loadHostKey() {
+	dir := ""
+	if cm.config != nil && cm.config.DataDir != "" {
+		dir = filepath.Join(cm.config.DataDir, sshDir)
+	}
+
+	hostKey, err := handler.LoadHostKey(dir)
+	if err != nil {
+		slog.Error(fmt.Sprintf("load SSH host key: %v", err))
+		return
+	}
+
+	cm.hostKey = hostKey
+}
+
+func (cm *CommandManager) handleHostKeyRequest(m *nats.Msg) {
+	cm.respondHostKey(m, nil)
+}
+
+// handleHostCertificate installs a host certificate, new SSH connections are offered it right away.
+func (cm *CommandManager) handleHostCertificate(m *nats.Msg) {
+	req, err := handler.JsonPayloadToConfig[HostCertRequest](json.RawMessage(m.Data))
+	if err != nil {
+		err = fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+	} else if cm.hostKey == nil {
+		err = errors.New("host key not loaded")
+	} else {
+		err = cm.hostKey.SetCertificate([]byte(req.Certificate))
+	}
+
+	if err != nil {
+		slog.Error(fmt.Sprintf("install SSH host certificate: %v", err))
+	}
+
+	cm.respondHostKey(m, err)
+}
+
+func (cm *CommandManager) respondHostKey(m *nats.Msg, err error) {
+	if m.Reply == "" {
+		return
+	}
+
+	info := cm.hostKeyInfo()
+	if err != nil {
+		info.Error = err.Error()
+	}
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		slog.Error(fmt.Sprintf("marshal host key: %v", err))
+		return
+	}
+
+	if err = m.Respond(data); err != nil {
+		slog.Error(fmt.Sprintf("respond to host key request: %v", err))
+	}
+}
+
+func (cm *CommandManager) hostKeyInfo() *HostKeyInfo {
+	info := &HostKeyInfo{Time: time.Now().UTC()}
+	if cm.hostKey == nil {
+		info.Error = "host key not loaded"
+		return info
+	}
+
+	public := cm.hostKey.PublicKey()
+	info.PublicKey = strings.TrimSpace(string(gossh.MarshalAuthorizedKey(public)))
+	info.Fingerprint = gossh.FingerprintSHA256(public)
+
+	if cert := cm.hostKey.Certificate(); cert != nil {
+		info.Certificate = strings.TrimSpace(string(gossh.MarshalAuthorizedKey(cert)))
+		if cert.ValidBefore <= math.MaxInt64 {
+			expiresAt := time.Unix(int64(cert.ValidBefore), 0).UTC()
+			info.CertificateExpiresAt = &expiresAt
+		}
+	}
+
+	return info
+}
@@ -0,0 +1,20 @@
+package remote_commands
+
+import "testing"
+
+func TestHostKeySurvivesRestart(t *testing.T) {
+	dataDir := t.TempDir()
+
+	cm := newTestManager(t, dataDir)
+	cm.loadHostKey()
+	first := cm.hostKeyInfo()
+	if first.Error != "" || first.PublicKey == "" {
+		t.Fatalf("unexpected host key info %+v", first)
+	}
+
+	restarted := newTestManager(t, dataDir)
+	restarted.loadHostKey()
+	if second := restarted.hostKeyInfo(); second.Fingerprint != first.Fingerprint {
+		t.Fatalf("host key changed from %s to %s", first.Fingerprint, second.Fingerprint)
+	}
+}
@@ -0,0 +1,226 @@
+package remote_commands
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/pocketbase/pocketbase/tools/security"
+)
+
+const commandsStateFile = "commands.json"
+
+// persistedCommand is the on-disk record of an active command. The payload may carry
+// secrets (CA keys, agent tokens) so it is stored encrypted with a key derived from the
+// device private key.
+type persistedCommand struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"command"`
+	RequestID string     `json:"request_id"`
+	Payload   string     `json:"payload"`
+	StartedAt time.Time  `json:"started_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Tunnel and the encrypted SecretKey keep a secret tunnel reachable by the same visitors.
+	Tunnel    *TunnelRequest `json:"tunnel,omitempty"`
+	SecretKey string         `json:"secret_key,omitempty"`
+}
+
+func (cm *CommandManager) statePath() string {
+	if cm.config == nil || cm.config.DataDir == "" {
+		return ""
+	}
+
+	return filepath.Join(cm.config.DataDir, commandsStateFile)
+}
+
+// stateKey derives the payload encryption key from the device private key.
+func (cm *CommandManager) stateKey() (string, error) {
+	if cm.config.TLS == nil || cm.config.TLS.KeyFile == "" {
+		return "", errors.New("device key not configured")
+	}
+
+	key, err := os.ReadFile(cm.config.TLS.KeyFile)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(key)
+	return string(sum[:]), nil
+}
+
+// saveCommands writes all active persistent commands to the data dir.
+func (cm *CommandManager) saveCommands() {
+	path := cm.statePath()
+	if path == "" {
+		return
+	}
+
+	cm.persistMu.Lock()
+	defer cm.persistMu.Unlock()
+
+	key, err := cm.stateKey()
+	if err != nil {
+		slog.Error(fmt.Sprintf("save commands: %v", err))
+		return
+	}
+
+	records := make([]*persistedCommand, 0)
+	for _, cmd := range cm.commands.GetAll() {
+		if !cmd.persistent {
+			continue
+		}
+
+		payload, err := json.Marshal(cmd.Payload)
+		if err != nil {
+			slog.Error(fmt.Sprintf("save commands: marshal payload: %v", err), slog.String("id", cmd.ID))
+			continue
+		}
+
+		encrypted, err := security.Encrypt(payload, key)
+		if err != nil {
+			slog.Error(fmt.Sprintf("save commands: encrypt payload: %v", err), slog.String("id", cmd.ID))
+			continue
+		}
+
+		record := &persistedCommand{
+			ID:        cmd.ID,
+			Name:      cmd.Name,
+			RequestID: cmd.RequestID,
+			Payload:   encrypted,
+			StartedAt: cmd.StartedAt,
+		}
+		if cmd.tunnel != nil {
+			record.Tunnel = cmd.tunnel
+			if record.SecretKey, err = security.Encrypt([]byte(cmd.secretKey), key); err != nil {
+				slog.Error(fmt.Sprintf("save commands: encrypt secret key: %v", err), slog.String("id", cmd.ID))
+				continue
+			}
+		}
+		if !cmd.ExpiresAt.IsZero() {
+			record.ExpiresAt = &cmd.ExpiresAt
+		}
+
+		records = append(records, record)
+	}
+
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		slog.Error(fmt.Sprintf("save commands: %v", err))
+		return
+	}
+
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0600); err == nil {
+		err = os.Rename(tmp, path)
+	}
+
+	if err != nil {
+		slog.Error(fmt.Sprintf("save commands: %v", err))
+	}
+}
+
+// restoreCommands restarts the commands that were active when the daemon stopped.
+// Expired commands are dropped.
+func (cm *CommandManager) restoreCommands() {
+	path := cm.statePath()
+	if path == "" {
+		return
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error(fmt.Sprintf("restore commands: %v", err))
+		}
+		return
+	}
+
+	var records []*persistedCommand
+	if err = json.Unmarshal(data, &records); err != nil {
+		slog.Error(fmt.Sprintf("restore commands: %v", err))
+		return
+	}
+
+	key, err := cm.stateKey()
+	if err != nil {
+		slog.Error(fmt.Sprintf("restore commands: %v", err))
+		return
+	}
+
+	now := time.Now()
+	for _, record := range records {
+		if record.ExpiresAt != nil && !record.ExpiresAt.After(now) {
+			slog.Info("Dropping expired command", slog.String("id", record.ID))
+			continue
+		}
+
+		if err := cm.restoreCommand(record, key); err != nil {
+			slog.Error(fmt.Sprintf("restore command: %v", err), slog.String("id", record.ID))
+			continue
+		}
+
+		slog.Info("Restored command", slog.String("id", record.ID), slog.String("request_id", record.RequestID))
+	}
+
+	// drop records that could not be restored
+	cm.saveCommands()
+}
+
+func (cm *CommandManager) restoreCommand(record *persistedCommand, key string) error {
+	// records written before instance IDs were introduced are keyed by the command name
+	if record.Name == "" {
+		record.Name = record.ID
+	}
+
+	def, err := Lookup(record.Name)
+	if err != nil {
+		return err
+	}
+
+	if !def.Persistent {
+		return errors.New("command does not survive restarts")
+	}
+
+	decrypted, err := security.Decrypt(record.Payload, key)
+	if err != nil {
+		return errors.Wrap(err, "decrypt payload")
+	}
+
+	var payload interface{}
+	if err = json.Unmarshal(decrypted, &payload); err != nil {
+		return errors.Wrap(err, "unmarshal payload")
+	}
+
+	cmd := &Command{
+		ID:         record.ID,
+		Name:       record.Name,
+		RequestID:  record.RequestID,
+		Payload:    payload,
+		StartedAt:  record.StartedAt,
+		persistent: true,
+	}
+	if record.ExpiresAt != nil {
+		cmd.ExpiresAt = *record.ExpiresAt
+	}
+
+	if record.Tunnel != nil {
+		secretKey, err := security.Decrypt(record.SecretKey, key)
+		if err != nil {
+			return errors.Wrap(err, "decrypt secret key")
+		}
+		cmd.tunnel, cmd.secretKey = record.Tunnel, string(secretKey)
+	}
+
+	if err = cm.AddCommand(cmd); err != nil {
+		return err
+	}
+
+	cm.publishResult(cmd.result(StatusRunning, nil))
+
+	return nil
+}
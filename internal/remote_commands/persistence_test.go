@@ -0,0 +1,244 @@
+package remote_commands
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Fyve-Labs/tessa-daemon/internal/config"
+	"github.com/Fyve-Labs/tessa-daemon/internal/remote_commands/handler"
+	"github.com/pocketbase/pocketbase/tools/security"
+)
+
+const (
+	testPersistentCommand = "test-persistent"
+	testEphemeralCommand  = "test-ephemeral"
+)
+
+type testPayload struct {
+	Secret string `json:"secret"`
+}
+
+// testHandler runs until it is stopped.
+type testHandler struct{}
+
+func (h *testHandler) Handle(ctx context.Context) error {
+	<-ctx.Done()
+	return nil
+}
+
+func (h *testHandler) Stop() error { return nil }
+
+func (h *testHandler) Output() interface{} { return nil }
+
+func newTestHandler(_ *Command, _ *testPayload) (handler.Handler, error) {
+	return &testHandler{}, nil
+}
+
+func init() {
+	Register(Definition{Name: testPersistentCommand, Persistent: true}, newTestHandler)
+	Register(Definition{Name: testEphemeralCommand}, newTestHandler)
+}
+
+func newTestManager(t *testing.T, dataDir string) *CommandManager {
+	t.Helper()
+
+	keyFile := filepath.Join(dataDir, "device.key")
+	if _, err := os.Stat(keyFile); os.IsNotExist(err) {
+		if err = os.WriteFile(keyFile, []byte("test device key"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cm := NewCommandManager(&config.Config{DataDir: dataDir, TLS: &config.TLSConfig{KeyFile: keyFile}}, nil, nil)
+	t.Cleanup(func() { _ = cm.Stop() })
+
+	return cm
+}
+
+func readRecords(t *testing.T, cm *CommandManager) []*persistedCommand {
+	t.Helper()
+
+	data, err := os.ReadFile(cm.statePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var records []*persistedCommand
+	if err = json.Unmarshal(data, &records); err != nil {
+		t.Fatal(err)
+	}
+
+	return records
+}
+
+func writeRecords(t *testing.T, cm *CommandManager, records []*persistedCommand) {
+	t.Helper()
+
+	data, err := json.Marshal(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = os.WriteFile(cm.statePath(), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func encryptPayload(t *testing.T, cm *CommandManager, payload interface{}) string {
+	t.Helper()
+
+	key, err := cm.stateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := security.Encrypt(data, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return encrypted
+}
+
+func TestSaveAndRestoreCommands(t *testing.T) {
+	dataDir := t.TempDir()
+	cm := newTestManager(t, dataDir)
+
+	expiresAt := time.Now().UTC().Add(time.Hour).Truncate(time.Second)
+	cmd := &Command{
+		ID:         "one",
+		Name:       testPersistentCommand,
+		RequestID:  "req-1",
+		Payload:    map[string]interface{}{"secret": "hunter2"},
+		ExpiresAt:  expiresAt,
+		persistent: true,
+	}
+	if err := cm.AddCommand(cmd); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(cm.statePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "hunter2") {
+		t.Fatal("payload is stored in plain text")
+	}
+
+	restored := newTestManager(t, dataDir)
+	restored.restoreCommands()
+
+	got, err := restored.GetCommand("one")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Name != testPersistentCommand || got.RequestID != "req-1" {
+		t.Errorf("restored %s/%s, want %s/req-1", got.Name, got.RequestID, testPersistentCommand)
+	}
+	if !got.ExpiresAt.Equal(expiresAt) {
+		t.Errorf("restored expiry %s, want %s", got.ExpiresAt, expiresAt)
+	}
+	if !got.StartedAt.Equal(cmd.StartedAt) {
+		t.Errorf("restored start time %s, want %s", got.StartedAt, cmd.StartedAt)
+	}
+
+	payload, _ := got.Payload.(map[string]interface{})
+	if payload["secret"] != "hunter2" {
+		t.Errorf("restored payload %v", got.Payload)
+	}
+}
+
+func TestRestoreCommandsDropsUnrestorableRecords(t *testing.T) {
+	cm := newTestManager(t, t.TempDir())
+
+	past := time.Now().UTC().Add(-time.Minute)
+	payload := encryptPayload(t, cm, map[string]interface{}{"secret": "s"})
+	writeRecords(t, cm, []*persistedCommand{
+		{ID: "keep", Name: testPersistentCommand, Payload: payload},
+		{ID: "expired", Name: testPersistentCommand, Payload: payload, ExpiresAt: &past},
+		{ID: "ephemeral", Name: testEphemeralCommand, Payload: payload},
+		{ID: "unknown", Name: "no-such-command", Payload: payload},
+		{ID: "corrupt", Name: testPersistentCommand, Payload: "not encrypted"},
+	})
+
+	cm.restoreCommands()
+
+	if ids := commandIDs(cm); len(ids) != 1 || ids[0] != "keep" {
+		t.Fatalf("restored %v, want [keep]", ids)
+	}
+
+	records := readRecords(t, cm)
+	if len(records) != 1 || records[0].ID != "keep" {
+		t.Fatalf("persisted %d records after restore, want only keep", len(records))
+	}
+}
+
+func TestRemoveCommandForgetsPersistedCommand(t *testing.T) {
+	cm := newTestManager(t, t.TempDir())
+
+	if err := cm.AddCommand(&Command{ID: "one", Name: testPersistentCommand, Payload: map[string]interface{}{}, persistent: true}); err != nil {
+		t.Fatal(err)
+	}
+	if len(readRecords(t, cm)) != 1 {
+		t.Fatal("command was not persisted")
+	}
+
+	if err := cm.RemoveCommand("one"); err != nil {
+		t.Fatal(err)
+	}
+	if records := readRecords(t, cm); len(records) != 0 {
+		t.Fatalf("persisted %d records after removal, want 0", len(records))
+	}
+}
+
+func commandIDs(cm *CommandManager) []string {
+	ids := make([]string, 0)
+	for _, cmd := range cm.Commands() {
+		ids = append(ids, cmd.ID)
+	}
+
+	return ids
+}
+
+func TestSaveCommandsEncryptsSecretKey(t *testing.T) {
+	cm := newTestManager(t, t.TempDir())
+
+	cmd := &Command{
+		ID:         "one",
+		Name:       testPersistentCommand,
+		Payload:    map[string]interface{}{},
+		persistent: true,
+		tunnel:     &TunnelRequest{Type: "stcp"},
+		secretKey:  "visitor-secret",
+	}
+	cm.commands.Set(cmd.ID, cmd)
+	cm.saveCommands()
+	cm.commands.Remove(cmd.ID) // never started, nothing to stop
+
+	records := readRecords(t, cm)
+	if len(records) != 1 || records[0].Tunnel == nil || records[0].Tunnel.Type != "stcp" {
+		t.Fatalf("persisted %+v", records)
+	}
+	if strings.Contains(records[0].SecretKey, "visitor-secret") {
+		t.Fatal("secret key is stored in plain text")
+	}
+
+	key, err := cm.stateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secretKey, err := security.Decrypt(records[0].SecretKey, key); err != nil || string(secretKey) != "visitor-secret" {
+		t.Errorf("decrypted secret key %q, %v", secretKey, err)
+	}
+}
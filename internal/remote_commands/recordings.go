@@ -0,0 +1,90 @@
+package remote_commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Fyve-Labs/tessa-daemon/internal/config"
+)
+
+// NatsRecordingsSubject receives finished SSH session recordings in chunks.
+const NatsRecordingsSubject = "tessa.devices.%s.ssh.recordings"
+
+const (
+	recordingsDir = "recordings"
+	// recordingChunkSize keeps chunks well below the default NATS max payload of 1MB.
+	recordingChunkSize = 256 << 10
+)
+
+// RecordingChunk is a piece of an asciicast recording. Chunks of a recording share its name
+// and are numbered from 1, the last one has Last set.
+type RecordingChunk struct {
+	ID   string    `json:"id"` // Command instance ID
+	Name string    `json:"name"`
+	Seq  int       `json:"seq"`
+	Last bool      `json:"last"`
+	Data []byte    `json:"data"`
+	Time time.Time `json:"time"`
+}
+
+func (cm *CommandManager) recordingsDir() string {
+	if cm.config == nil || cm.config.DataDir == "" {
+		return ""
+	}
+
+	return filepath.Join(cm.config.DataDir, recordingsDir)
+}
+
+// uploadRecording publishes a finished recording to the control plane. The local copy is kept
+// until the recording retention deletes it.
+func (cm *CommandManager) uploadRecording(cmd *Command, path string) {
+	if err := cm.publishRecording(cmd, path); err != nil {
+		slog.Error(fmt.Sprintf("upload session recording: %v", err), slog.String("id", cmd.ID), slog.String("path", path))
+		return
+	}
+
+	slog.Info("Uploaded session recording", slog.String("id", cmd.ID), slog.String("path", path))
+}
+
+func (cm *CommandManager) publishRecording(cmd *Command, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	subject := fmt.Sprintf(NatsRecordingsSubject, config.DeviceName)
+	buf := make([]byte, recordingChunkSize)
+	for seq := 1; ; seq++ {
+		n, err := io.ReadFull(f, buf)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return err
+		}
+
+		data, err := json.Marshal(&RecordingChunk{
+			ID:   cmd.ID,
+			Name: filepath.Base(path),
+			Seq:  seq,
+			Last: last,
+			Data: buf[:n],
+			Time: time.Now().UTC(),
+		})
+		if err != nil {
+			return err
+		}
+
+		if err = cm.natsConn.Publish(subject, data); err != nil {
+			return err
+		}
+
+		if last {
+			return cm.natsConn.Flush()
+		}
+	}
+}
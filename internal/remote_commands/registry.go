@@ -0,0 +1,126 @@
+package remote_commands
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Fyve-Labs/tessa-daemon/internal/remote_commands/handler"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrUnknownCommand = errors.New("unknown command")
+	ErrInvalidPayload = errors.New("invalid payload")
+)
+
+// Factory builds the handler of a command from its decoded and validated payload.
+type Factory[T any] func(cmd *Command, cfg *T) (handler.Handler, error)
+
+// Definition describes a command that can be requested over NATS.
+type Definition struct {
+	Name string
+	// DefaultTTL bounds the command lifetime when the request sets no expiry, 0 means no limit.
+	DefaultTTL time.Duration
+	// MaxTTL caps the lifetime a request can ask for, 0 means no limit.
+	MaxTTL time.Duration
+	// Persistent commands are saved in the data dir and restarted after a daemon restart.
+	Persistent bool
+	// Job commands run to completion on their own. They are answered accepted once queued and
+	// their outcome is published when they end.
+	Job bool
+
+	validate   func(payload interface{}) error
+	newHandler func(cmd *Command) (handler.Handler, error)
+}
+
+var registry = map[string]*Definition{}
+
+// Register adds a command to the registry. The payload of every request is decoded into T
+// and validated before the factory is called.
+func Register[T any](def Definition, factory Factory[T]) {
+	if _, ok := registry[def.Name]; ok {
+		panic(fmt.Sprintf("command %s is already registered", def.Name))
+	}
+
+	def.validate = func(payload interface{}) error {
+		if _, err := handler.JsonPayloadToConfig[T](payload); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+		}
+
+		return nil
+	}
+
+	def.newHandler = func(cmd *Command) (handler.Handler, error) {
+		cfg, err := handler.JsonPayloadToConfig[T](cmd.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+		}
+
+		return factory(cmd, cfg)
+	}
+
+	registry[def.Name] = &def
+}
+
+// Lookup returns the definition of a registered command.
+func Lookup(name string) (*Definition, error) {
+	def, ok := registry[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownCommand, name)
+	}
+
+	return def, nil
+}
+
+func init() {
+	Register(Definition{Name: StartSSHCommand, DefaultTTL: DefaultSSHLifetime, MaxTTL: MaxSSHLifetime, Persistent: true}, newSSHServer)
+	Register(Definition{Name: EnableBeszelAgentCommand, Persistent: true}, newBeszelAgent)
+	Register(Definition{Name: ExecCommand, Job: true}, newExec)
+	Register(Definition{Name: ExposeCommand, Persistent: true}, newExpose)
+}
+
+func newSSHServer(cmd *Command, cfg *handler.SSHServerConfig) (handler.Handler, error) {
+	opts := handler.SSHServerOptions{
+		Revocations: cmd.manager.revocations,
+		HostKey:     cmd.manager.hostKey,
+		Version:     cmd.manager.config.Version,
+	}
+	if cfg.Record {
+		dir := cmd.manager.recordingsDir()
+		if dir == "" {
+			return nil, errors.New("session recording needs a data dir")
+		}
+
+		opts.Recorder = &handler.Recorder{
+			Dir:       dir,
+			CommandID: cmd.ID,
+			Input:     cfg.RecordInput,
+			Retention: cfg.RecordingRetention,
+			Finished: func(path string) {
+				cmd.manager.uploadRecording(cmd, path)
+			},
+		}
+	}
+
+	return handler.NewSSHServerHandler(cfg, opts)
+}
+
+func newExec(cmd *Command, cfg *handler.ExecConfig) (handler.Handler, error) {
+	return handler.NewExecHandler(cfg, func(stream string, data []byte) {
+		cmd.manager.publishOutput(cmd, stream, data)
+	})
+}
+
+// newExpose publishes the service under the instance ID, so each exposed service is a command
+// instance that is listed and stopped like the others.
+func newExpose(cmd *Command, cfg *handler.ExposeConfig) (handler.Handler, error) {
+	if cmd.manager.tunnelManager == nil {
+		return nil, errors.New("tunnel not available")
+	}
+
+	return handler.NewExposeHandler(cmd.ID, cfg, cmd.manager.tunnelManager)
+}
+
+func newBeszelAgent(_ *Command, cfg *handler.BeszelConfig) (handler.Handler, error) {
+	return handler.NewBeszelAgentHandler(cfg)
+}
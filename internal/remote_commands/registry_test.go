@@ -0,0 +1,82 @@
+package remote_commands
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Fyve-Labs/tessa-daemon/internal/remote_commands/handler"
+)
+
+const testCountedCommand = "test-counted"
+
+// testCountedBuilds counts the handlers built for testCountedCommand.
+var testCountedBuilds atomic.Int64
+
+func init() {
+	Register(Definition{Name: testCountedCommand}, func(_ *Command, _ *testPayload) (handler.Handler, error) {
+		testCountedBuilds.Add(1)
+		return &testHandler{}, nil
+	})
+}
+
+func TestRegisterDuplicatePanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a command twice did not panic")
+		}
+	}()
+
+	Register(Definition{Name: testCountedCommand}, newTestHandler)
+}
+
+func TestUnknownCommandIsRejected(t *testing.T) {
+	cm := newTestManager(t, t.TempDir())
+	msgs := recordPublished(cm)
+
+	if _, err := cm.newCommand(&CommandRequest{Command: "no-such-command"}); !errors.Is(err, ErrUnknownCommand) {
+		t.Fatalf("newCommand: got %v, want an unknown command", err)
+	}
+
+	result := request(t, cm, msgs, &CommandRequest{RequestID: "req-1", Command: "no-such-command"})
+	if result.Status != StatusRejected || !strings.Contains(result.Error, ErrUnknownCommand.Error()) || result.RequestID != "req-1" {
+		t.Fatalf("reply %+v", result)
+	}
+	if cm.commands.Length() != 0 {
+		t.Errorf("%d commands running after an unknown command", cm.commands.Length())
+	}
+}
+
+func TestInvalidPayloadIsRejected(t *testing.T) {
+	cm := newTestManager(t, t.TempDir())
+	msgs := recordPublished(cm)
+	builds := testCountedBuilds.Load()
+
+	for _, payload := range []interface{}{
+		map[string]interface{}{"unknown": true},
+		map[string]interface{}{"secret": 42},
+		"not an object",
+	} {
+		if _, err := cm.newCommand(&CommandRequest{Command: testCountedCommand, Payload: payload}); !errors.Is(err, ErrInvalidPayload) {
+			t.Errorf("newCommand with payload %v: got %v, want an invalid payload", payload, err)
+		}
+
+		result := request(t, cm, msgs, &CommandRequest{Command: testCountedCommand, Payload: payload})
+		if result.Status != StatusRejected || !strings.Contains(result.Error, ErrInvalidPayload.Error()) {
+			t.Errorf("reply to payload %v: %+v", payload, result)
+		}
+	}
+
+	// Rejected requests never get as far as building a handler
+	if n := testCountedBuilds.Load() - builds; n != 0 {
+		t.Errorf("built %d handlers for invalid payloads", n)
+	}
+	if cm.commands.Length() != 0 {
+		t.Errorf("%d commands running after invalid payloads", cm.commands.Length())
+	}
+
+	if result := request(t, cm, msgs, &CommandRequest{Command: testCountedCommand, Payload: map[string]interface{}{"secret": "s"}}); result.Status != StatusRunning {
+		t.Errorf("reply to a valid payload %+v", result)
+	}
+}
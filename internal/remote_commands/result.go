@@ -0,0 +1,77 @@
+package remote_commands
+
+import (
+	"time"
+
+	"github.com/Fyve-Labs/tessa-daemon/internal/tunnel"
+)
+
+// NatsResultsSubject receives command results that cannot be sent as a direct reply
+// and lifecycle events of running commands.
+const NatsResultsSubject = "tessa.devices.%s.commands.results"
+
+// NatsOutputSubject streams the output of a command instance as it is produced.
+const NatsOutputSubject = "tessa.devices.%s.commands.%s.output"
+
+type CommandStatus string
+
+const (
+	StatusAccepted  CommandStatus = "accepted" // A job was queued, its outcome follows on the results subject
+	StatusRunning   CommandStatus = "running"
+	StatusSucceeded CommandStatus = "succeeded"
+	StatusFailed    CommandStatus = "failed"
+	StatusRejected  CommandStatus = "rejected"
+	StatusStopped   CommandStatus = "stopped"
+	StatusExpired   CommandStatus = "expired"
+)
+
+// CommandResult is the envelope every command request is answered with.
+type CommandResult struct {
+	RequestID string        `json:"request_id"`
+	ID        string        `json:"id,omitempty"` // Command instance ID
+	Command   string        `json:"command"`
+	Status    CommandStatus `json:"status"`
+	Error     string        `json:"error,omitempty"`
+	Output    interface{}   `json:"output,omitempty"`
+	ExpiresAt *time.Time    `json:"expires_at,omitempty"`
+	Tunnel    *TunnelOutput `json:"tunnel,omitempty"`
+	Time      time.Time     `json:"time"`
+}
+
+// TunnelOutput tells where a command's local port is published through the device tunnel.
+type TunnelOutput struct {
+	Domain     string `json:"domain"`
+	RemotePort int    `json:"remote_port,omitempty"` // Set for plain TCP proxies, Domain is then the tunnel server
+	LocalPort  int    `json:"local_port"`
+	// Type is stcp or xtcp for secret tunnels, Domain is then the server name visitors dial.
+	Type string `json:"type,omitempty"`
+	// SecretKey lets a visitor connect to a secret tunnel, it is only sent in the start result.
+	SecretKey string `json:"secret_key,omitempty"`
+	// Status is the state of the proxy on the tunnel server.
+	Status *tunnel.ProxyStatus `json:"status,omitempty"`
+}
+
+// OutputChunk is a piece of a command's stdout or stderr. Seq orders chunks of one instance.
+type OutputChunk struct {
+	RequestID string    `json:"request_id"`
+	ID        string    `json:"id"`
+	Stream    string    `json:"stream"`
+	Seq       int64     `json:"seq"`
+	Data      string    `json:"data"`
+	Time      time.Time `json:"time"`
+}
+
+func newCommandResult(requestID, command string, status CommandStatus, err error) *CommandResult {
+	result := &CommandResult{
+		RequestID: requestID,
+		Command:   command,
+		Status:    status,
+		Time:      time.Now().UTC(),
+	}
+
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	return result
+}
@@ -0,0 +1,133 @@
+package remote_commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Fyve-Labs/tessa-daemon/internal/remote_commands/handler"
+	"github.com/nats-io/nats.go"
+)
+
+// NatsRevocationsSubject receives the device revocation list of SSH user certificates. Each
+// update replaces the previous list.
+const NatsRevocationsSubject = "tessa.devices.%s.ssh.revocations"
+
+const revocationsFile = "revocations.json"
+
+// RevocationResult is the reply to a revocation list update.
+type RevocationResult struct {
+	Error string `json:"error,omitempty"`
+	// Disconnected counts the connections closed because their certificate is now revoked.
+	Disconnected int       `json:"disconnected"`
+	Time         time.Time `json:"time"`
+}
+
+func (cm *CommandManager) revocationsPath() string {
+	if cm.config == nil || cm.config.DataDir == "" {
+		return ""
+	}
+
+	return filepath.Join(cm.config.DataDir, revocationsFile)
+}
+
+// handleRevocationUpdate replaces the device revocation list and cuts off the connections it revokes.
+func (cm *CommandManager) handleRevocationUpdate(m *nats.Msg) {
+	result := &RevocationResult{}
+	if err := cm.updateRevocations(m.Data); err != nil {
+		slog.Error(fmt.Sprintf("update revocation list: %v", err))
+		result.Error = err.Error()
+	} else {
+		result.Disconnected = cm.disconnectRevoked()
+	}
+
+	if m.Reply == "" {
+		return
+	}
+
+	result.Time = time.Now().UTC()
+	data, err := json.Marshal(result)
+	if err != nil {
+		slog.Error(fmt.Sprintf("marshal revocation result: %v", err))
+		return
+	}
+
+	if err = m.Respond(data); err != nil {
+		slog.Error(fmt.Sprintf("respond to revocation update: %v", err))
+	}
+}
+
+// updateRevocations applies a revocation list and saves it to the data dir, so it still applies
+// after a restart.
+func (cm *CommandManager) updateRevocations(data []byte) error {
+	cfg, err := handler.JsonPayloadToConfig[handler.RevocationConfig](json.RawMessage(data))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+	}
+
+	if err = cm.revocations.Update(cfg); err != nil {
+		return err
+	}
+
+	slog.Info("Updated SSH revocation list", "serials", len(cfg.Serials), "key_ids", len(cfg.KeyIDs), "krl", len(cfg.KRL) > 0)
+
+	path := cm.revocationsPath()
+	if path == "" {
+		return nil
+	}
+
+	if data, err = json.Marshal(cfg); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0600); err == nil {
+		err = os.Rename(tmp, path)
+	}
+
+	return err
+}
+
+// loadRevocations applies the revocation list saved in the data dir.
+func (cm *CommandManager) loadRevocations() {
+	path := cm.revocationsPath()
+	if path == "" {
+		return
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error(fmt.Sprintf("load revocation list: %v", err))
+		}
+		return
+	}
+
+	var cfg handler.RevocationConfig
+	if err = json.Unmarshal(data, &cfg); err == nil {
+		err = cm.revocations.Update(&cfg)
+	}
+
+	if err != nil {
+		slog.Error(fmt.Sprintf("load revocation list: %v", err))
+	}
+}
+
+// disconnectRevoked asks every running handler to close the connections of revoked users.
+func (cm *CommandManager) disconnectRevoked() int {
+	disconnected := 0
+	for _, cmd := range cm.commands.Values() {
+		if !cmd.started.Load() {
+			continue
+		}
+
+		if r, ok := cmd.handler.(handler.Revocable); ok {
+			disconnected += r.DisconnectRevoked()
+		}
+	}
+
+	return disconnected
+}
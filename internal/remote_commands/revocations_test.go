@@ -0,0 +1,36 @@
+package remote_commands
+
+import (
+	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestRevocationsSurviveRestart(t *testing.T) {
+	dataDir := t.TempDir()
+	cm := newTestManager(t, dataDir)
+
+	if err := cm.updateRevocations([]byte(`{"serials": [42], "key_ids": ["leaver@example.com"]}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cm.updateRevocations([]byte(`{"unknown": true}`)); err == nil {
+		t.Fatal("expected an invalid update to be rejected")
+	}
+
+	restarted := newTestManager(t, dataDir)
+	restarted.loadRevocations()
+
+	for _, tc := range []struct {
+		cert    *gossh.Certificate
+		revoked bool
+	}{
+		{&gossh.Certificate{Serial: 42, KeyId: "someone@example.com"}, true},
+		{&gossh.Certificate{Serial: 1, KeyId: "leaver@example.com"}, true},
+		{&gossh.Certificate{Serial: 1, KeyId: "someone@example.com"}, false},
+	} {
+		if got := restarted.revocations.IsRevoked(tc.cert); got != tc.revoked {
+			t.Errorf("serial %d, key id %s: revoked %v, want %v", tc.cert.Serial, tc.cert.KeyId, got, tc.revoked)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package remote_commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/Fyve-Labs/tessa-daemon/internal/remote_commands/handler"
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+const (
+	// NatsSessionsSubject answers requests with the SSH sessions open on the device.
+	NatsSessionsSubject = "tessa.devices.%s.ssh.sessions"
+	// NatsSessionsKillSubject disconnects SSH sessions.
+	NatsSessionsKillSubject = "tessa.devices.%s.ssh.sessions.kill"
+
+	// defaultKillDelay gives users time to read the message sent before they are disconnected.
+	defaultKillDelay = 5 * time.Second
+	maxKillDelay     = 5 * time.Minute
+)
+
+// SessionInfo is an SSH session and the command instance serving it.
+type SessionInfo struct {
+	CommandID string `json:"command_id"`
+	*handler.SSHSessionOutput
+}
+
+// SessionList is the reply to a sessions request.
+type SessionList struct {
+	Sessions []*SessionInfo `json:"sessions"`
+	Time     time.Time      `json:"time"`
+}
+
+// KillSessionsRequest disconnects the sessions matching the filter, or every session with All.
+// A message is written to the sessions Delay seconds before they are closed.
+type KillSessionsRequest struct {
+	handler.SSHSessionFilter
+	CommandID string `json:"command_id,omitempty"`
+	All       bool   `json:"all,omitempty"`
+	Message   string `json:"message,omitempty"`
+	Delay     *int64 `json:"delay,omitempty"`
+}
+
+func (r *KillSessionsRequest) Validate() error {
+	if !r.All && r.ID == "" && r.User == "" && r.KeyID == "" && r.CommandID == "" {
+		return errors.New("a session filter or all is required")
+	}
+
+	if r.Delay != nil && (*r.Delay < 0 || time.Duration(*r.Delay)*time.Second > maxKillDelay) {
+		return fmt.Errorf("delay must be between 0 and %d seconds", int64(maxKillDelay/time.Second))
+	}
+
+	return nil
+}
+
+// delay returns how long sessions are given between the message and the disconnection.
+func (r *KillSessionsRequest) delay() time.Duration {
+	if r.Delay == nil {
+		return defaultKillDelay
+	}
+
+	return time.Duration(*r.Delay) * time.Second
+}
+
+// KillSessionsResult is the reply to a kill request.
+type KillSessionsResult struct {
+	Disconnected int       `json:"disconnected"`
+	Error        string    `json:"error,omitempty"`
+	Time         time.Time `json:"time"`
+}
+
+// sessionTrackers returns the running handlers with sessions, by command instance ID.
+func (cm *CommandManager) sessionTrackers() map[string]handler.SessionTracker {
+	trackers := make(map[string]handler.SessionTracker)
+	for _, cmd := range cm.commands.Values() {
+		if !cmd.started.Load() {
+			continue
+		}
+
+		if t, ok := cmd.handler.(handler.SessionTracker); ok {
+			trackers[cmd.ID] = t
+		}
+	}
+
+	return trackers
+}
+
+// Sessions lists the SSH sessions of every command instance, oldest first.
+func (cm *CommandManager) Sessions() []*SessionInfo {
+	sessions := make([]*SessionInfo, 0)
+	for id, t := range cm.sessionTrackers() {
+		for _, s := range t.Sessions() {
+			sessions = append(sessions, &SessionInfo{CommandID: id, SSHSessionOutput: s})
+		}
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].StartedAt.Before(sessions[j].StartedAt)
+	})
+
+	return sessions
+}
+
+// KillSessions disconnects the sessions matching a request and returns how many matched.
+func (cm *CommandManager) KillSessions(req *KillSessionsRequest) int {
+	disconnected := 0
+	for id, t := range cm.sessionTrackers() {
+		if req.CommandID != "" && req.CommandID != id {
+			continue
+		}
+
+		disconnected += t.Disconnect(req.SSHSessionFilter, req.Message, req.delay())
+	}
+
+	slog.Info(fmt.Sprintf("Disconnecting %d SSH session(s)", disconnected),
+		"id", req.ID, "user", req.User, "key_id", req.KeyID, "command_id", req.CommandID)
+	return disconnected
+}
+
+func (cm *CommandManager) handleSessionsRequest(m *nats.Msg) {
+	if m.Reply == "" {
+		return
+	}
+
+	cm.reply(m, &SessionList{Sessions: cm.Sessions(), Time: time.Now().UTC()})
+}
+
+func (cm *CommandManager) handleKillSessionsRequest(m *nats.Msg) {
+	result := &KillSessionsResult{}
+	req, err := handler.JsonPayloadToConfig[KillSessionsRequest](json.RawMessage(m.Data))
+	if err != nil {
+		slog.Warn(fmt.Sprintf("kill SSH sessions: %v", err))
+		result.Error = fmt.Errorf("%w: %v", ErrInvalidPayload, err).Error()
+	} else {
+		result.Disconnected = cm.KillSessions(req)
+	}
+
+	if m.Reply == "" {
+		return
+	}
+
+	result.Time = time.Now().UTC()
+	cm.reply(m, result)
+}
+
+// reply answers a request with a JSON value.
+func (cm *CommandManager) reply(m *nats.Msg, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		slog.Error(fmt.Sprintf("marshal reply: %v", err), "subject", m.Subject)
+		return
+	}
+
+	if err = m.Respond(data); err != nil {
+		slog.Error(fmt.Sprintf("respond: %v", err), "subject", m.Subject)
+	}
+}
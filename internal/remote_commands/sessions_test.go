@@ -0,0 +1,39 @@
+package remote_commands
+
+import (
+	"testing"
+
+	"github.com/Fyve-Labs/tessa-daemon/internal/remote_commands/handler"
+)
+
+func TestKillSessionsRequestValidate(t *testing.T) {
+	delay := func(seconds int64) *int64 { return &seconds }
+
+	for name, tc := range map[string]struct {
+		req   KillSessionsRequest
+		valid bool
+	}{
+		"no filter":      {KillSessionsRequest{}, false},
+		"all":            {KillSessionsRequest{All: true}, true},
+		"key id":         {KillSessionsRequest{SSHSessionFilter: handler.SSHSessionFilter{KeyID: "leaver@example.com"}}, true},
+		"command id":     {KillSessionsRequest{CommandID: "start-ssh"}, true},
+		"negative delay": {KillSessionsRequest{All: true, Delay: delay(-1)}, false},
+		"long delay":     {KillSessionsRequest{All: true, Delay: delay(3600)}, false},
+		"no delay":       {KillSessionsRequest{All: true, Delay: delay(0)}, true},
+	} {
+		if err := tc.req.Validate(); (err == nil) != tc.valid {
+			t.Errorf("%s: got error %v, want valid %v", name, err, tc.valid)
+		}
+	}
+}
+
+func TestKillSessionsRequestDelay(t *testing.T) {
+	req, err := handler.JsonPayloadToConfig[KillSessionsRequest](map[string]interface{}{"user": "root", "message": "bye"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if req.User != "root" || req.delay() != defaultKillDelay {
+		t.Fatalf("unexpected request %+v, delay %s", req, req.delay())
+	}
+}
@@ -0,0 +1,69 @@
+package remote_commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/Fyve-Labs/tessa-daemon/internal/config"
+	"github.com/Fyve-Labs/tessa-daemon/internal/tunnel"
+)
+
+// NatsTunnelStatusSubject receives the tunnel status whenever the connection to the tunnel server
+// or one of its proxies changes state.
+const NatsTunnelStatusSubject = "tessa.devices.%s.tunnel.status"
+
+// tunnelStartTimeout is how long a start request waits for the command's proxy to come up or
+// fail, so the result tells whether the command is reachable.
+const tunnelStartTimeout = 3 * time.Second
+
+// TunnelStatusEvent is published on NatsTunnelStatusSubject.
+type TunnelStatusEvent struct {
+	*tunnel.Status
+	Time time.Time `json:"time"`
+}
+
+func (cm *CommandManager) publishTunnelStatus(status *tunnel.Status) {
+	if status.Error != "" {
+		slog.Warn(fmt.Sprintf("Tunnel %s: %s", status.State, status.Error), slog.Int("attempts", status.ConnectAttempts))
+	} else {
+		slog.Info(fmt.Sprintf("Tunnel %s", status.State))
+	}
+
+	if cm.natsConn == nil {
+		return
+	}
+
+	data, err := json.Marshal(&TunnelStatusEvent{Status: status, Time: time.Now().UTC()})
+	if err != nil {
+		slog.Error(fmt.Sprintf("marshal tunnel status: %v", err))
+		return
+	}
+
+	if err = cm.natsConn.Publish(fmt.Sprintf(NatsTunnelStatusSubject, config.DeviceName), data); err != nil {
+		slog.Error(fmt.Sprintf("publish tunnel status: %v", err))
+	}
+}
+
+// tunnelStatus returns the state of the command's proxy, or nil without one.
+func (cmd *Command) tunnelStatus() *tunnel.ProxyStatus {
+	if cmd.proxyPort == 0 || cmd.manager.tunnelManager == nil {
+		return nil
+	}
+
+	return cmd.manager.tunnelManager.ProxyStatus("127.0.0.1", cmd.proxyPort)
+}
+
+// waitTunnel waits up to timeout for the command's proxy to leave the new state.
+func (cmd *Command) waitTunnel(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for {
+		status := cmd.tunnelStatus()
+		if status == nil || status.Status != tunnel.ProxyNew || status.Error != "" || time.Now().After(deadline) {
+			return
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,209 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+
+	v1 "github.com/fatedier/frp/pkg/config/v1"
+	"github.com/fatedier/frp/pkg/config/v1/validation"
+	"github.com/pkg/errors"
+)
+
+// Types of exposed services.
+const (
+	ServiceTCP   = "tcp"
+	ServiceUDP   = "udp"
+	ServiceHTTP  = "http"
+	ServiceHTTPS = "https"
+)
+
+// subdomainPattern keeps subdomains to a single DNS label.
+var subdomainPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// Service is a local service published through the tunnel under a name.
+type Service struct {
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	LocalIP   string `json:"local_ip"`
+	LocalPort int    `json:"local_port"`
+	// RemotePort is the tunnel server port tcp and udp services are published on.
+	RemotePort int `json:"remote_port,omitempty"`
+	// Subdomain of the tunnel server domain http and https services are served at, it defaults to
+	// the proxy name. https services are passed through, the local service terminates TLS.
+	Subdomain string `json:"subdomain,omitempty"`
+	// HTTPUser and HTTPPassword protect an http service with basic auth.
+	HTTPUser     string `json:"http_user,omitempty"`
+	HTTPPassword string `json:"-"`
+	// Endpoint is where clients reach the service: the tunnel server address and port of tcp and udp
+	// services, the subdomain of http and https services.
+	Endpoint string `json:"endpoint,omitempty"`
+}
+
+// Validate checks the service settings, the name is checked when it is exposed.
+func (s *Service) Validate() error {
+	if s.LocalPort < 1 || s.LocalPort > 65535 {
+		return fmt.Errorf("invalid local_port: %d", s.LocalPort)
+	}
+
+	if s.LocalIP != "" && net.ParseIP(s.LocalIP) == nil {
+		return fmt.Errorf("invalid local_ip: %s", s.LocalIP)
+	}
+
+	switch s.Type {
+	case ServiceTCP, ServiceUDP:
+		if s.RemotePort < 1 || s.RemotePort > 65535 {
+			return fmt.Errorf("remote_port is required for %s services", s.Type)
+		}
+		if s.Subdomain != "" {
+			return fmt.Errorf("subdomain is only supported by http and https services")
+		}
+	case ServiceHTTP, ServiceHTTPS:
+		if s.RemotePort != 0 {
+			return fmt.Errorf("remote_port is only supported by tcp and udp services")
+		}
+		if s.Subdomain != "" && !subdomainPattern.MatchString(s.Subdomain) {
+			return fmt.Errorf("invalid subdomain: %s", s.Subdomain)
+		}
+	default:
+		return fmt.Errorf("invalid type %q, must be tcp, udp, http or https", s.Type)
+	}
+
+	if s.HTTPUser != "" || s.HTTPPassword != "" {
+		if s.Type != ServiceHTTP {
+			return errors.New("basic auth is only supported by http services")
+		}
+		if s.HTTPUser == "" || s.HTTPPassword == "" {
+			return errors.New("basic auth needs a user and a password")
+		}
+	}
+
+	return nil
+}
+
+// proxyConfig builds the frp proxy publishing the service as proxyName.
+func (s *Service) proxyConfig(proxyName string) (v1.ProxyConfigurer, error) {
+	base := v1.ProxyBaseConfig{
+		Type: s.Type,
+		Name: proxyName,
+		ProxyBackend: v1.ProxyBackend{
+			LocalIP:   s.LocalIP,
+			LocalPort: s.LocalPort,
+		},
+	}
+
+	var cfg v1.ProxyConfigurer
+	switch s.Type {
+	case ServiceTCP:
+		cfg = &v1.TCPProxyConfig{ProxyBaseConfig: base, RemotePort: s.RemotePort}
+	case ServiceUDP:
+		cfg = &v1.UDPProxyConfig{ProxyBaseConfig: base, RemotePort: s.RemotePort}
+	case ServiceHTTP:
+		cfg = &v1.HTTPProxyConfig{
+			ProxyBaseConfig: base,
+			DomainConfig:    v1.DomainConfig{SubDomain: s.Subdomain},
+			HTTPUser:        s.HTTPUser,
+			HTTPPassword:    s.HTTPPassword,
+		}
+	case ServiceHTTPS:
+		cfg = &v1.HTTPSProxyConfig{ProxyBaseConfig: base, DomainConfig: v1.DomainConfig{SubDomain: s.Subdomain}}
+	default:
+		return nil, fmt.Errorf("invalid type %q", s.Type)
+	}
+
+	cfg.Complete("")
+	if err := validation.ValidateProxyConfigurerForClient(cfg); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// serviceKey keys exposed services among the proxies, apart from the "IP:port" keys of Proxy.
+func serviceKey(name string) string {
+	return "service/" + name
+}
+
+// Expose publishes a local service under name, replacing the service exposed under the same name.
+// It returns the service with its endpoint.
+func (m *Manager) Expose(svc Service) (*Service, error) {
+	if svc.Name == "" {
+		return nil, errors.New("service name is required")
+	}
+
+	if err := svc.Validate(); err != nil {
+		return nil, err
+	}
+
+	if svc.LocalIP == "" {
+		svc.LocalIP = "127.0.0.1"
+	}
+
+	proxyName := m.proxyName(svc.Name)
+	switch svc.Type {
+	case ServiceTCP, ServiceUDP:
+		svc.Endpoint = net.JoinHostPort(m.serverAddr, strconv.Itoa(svc.RemotePort))
+	default:
+		if svc.Subdomain == "" {
+			svc.Subdomain = proxyName
+		}
+		svc.Endpoint = svc.Subdomain
+	}
+
+	proxyCfg, err := svc.proxyConfig(proxyName)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := serviceKey(svc.Name)
+	if err = m.checkProxyName(key, proxyName); err != nil {
+		return nil, err
+	}
+
+	m.proxyCfgs.Set(key, proxyCfg)
+	m.changed()
+
+	exposed := svc
+	m.services.Set(svc.Name, &exposed)
+
+	return &svc, nil
+}
+
+// Unexpose stops publishing the service exposed under name. It returns false if there is none.
+func (m *Manager) Unexpose(name string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.services.Has(name) {
+		return false
+	}
+
+	m.services.Remove(name)
+	m.proxyCfgs.Remove(serviceKey(name))
+	m.changed()
+
+	return true
+}
+
+// Services lists the exposed services by name.
+func (m *Manager) Services() []*Service {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	services := make([]*Service, 0, m.services.Length())
+	for _, svc := range m.services.GetAll() {
+		s := *svc
+		services = append(services, &s)
+	}
+
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Name < services[j].Name
+	})
+
+	return services
+}
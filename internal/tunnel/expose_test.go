@@ -0,0 +1,65 @@
+package tunnel
+
+import (
+	"testing"
+
+	v1 "github.com/fatedier/frp/pkg/config/v1"
+)
+
+func TestServiceValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		svc   Service
+		valid bool
+	}{
+		{"tcp", Service{Type: ServiceTCP, LocalPort: 1883, RemotePort: 21883}, true},
+		{"udp", Service{Type: ServiceUDP, LocalIP: "192.168.1.10", LocalPort: 161, RemotePort: 20161}, true},
+		{"http", Service{Type: ServiceHTTP, LocalPort: 8080, Subdomain: "dashboard"}, true},
+		{"http basic auth", Service{Type: ServiceHTTP, LocalPort: 8080, HTTPUser: "admin", HTTPPassword: "secret"}, true},
+		{"https", Service{Type: ServiceHTTPS, LocalPort: 8443}, true},
+		{"unknown type", Service{Type: "sctp", LocalPort: 80}, false},
+		{"no local port", Service{Type: ServiceHTTP}, false},
+		{"bad local ip", Service{Type: ServiceHTTP, LocalIP: "localhost", LocalPort: 80}, false},
+		{"tcp without remote port", Service{Type: ServiceTCP, LocalPort: 1883}, false},
+		{"tcp subdomain", Service{Type: ServiceTCP, LocalPort: 1883, RemotePort: 21883, Subdomain: "mqtt"}, false},
+		{"http remote port", Service{Type: ServiceHTTP, LocalPort: 8080, RemotePort: 8080}, false},
+		{"bad subdomain", Service{Type: ServiceHTTP, LocalPort: 8080, Subdomain: "a.b"}, false},
+		{"basic auth without password", Service{Type: ServiceHTTP, LocalPort: 8080, HTTPUser: "admin"}, false},
+		{"https basic auth", Service{Type: ServiceHTTPS, LocalPort: 8443, HTTPUser: "admin", HTTPPassword: "secret"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.svc.Validate(); (err == nil) != tt.valid {
+				t.Errorf("Validate() = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestServiceProxyConfig(t *testing.T) {
+	svc := Service{Type: ServiceHTTP, LocalPort: 8080, Subdomain: "dashboard", HTTPUser: "admin", HTTPPassword: "secret"}
+	cfg, err := svc.proxyConfig("my-device-dashboard")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	http, ok := cfg.(*v1.HTTPProxyConfig)
+	if !ok {
+		t.Fatalf("got %T, want an http proxy", cfg)
+	}
+	if http.Name != "my-device-dashboard" || http.LocalIP != "127.0.0.1" || http.LocalPort != 8080 {
+		t.Errorf("proxy %s to %s:%d", http.Name, http.LocalIP, http.LocalPort)
+	}
+	if http.SubDomain != "dashboard" || http.HTTPUser != "admin" || http.HTTPPassword != "secret" {
+		t.Errorf("subdomain %q, basic auth %q:%q", http.SubDomain, http.HTTPUser, http.HTTPPassword)
+	}
+
+	svc = Service{Type: ServiceUDP, LocalPort: 161, RemotePort: 20161}
+	if cfg, err = svc.proxyConfig("my-device-snmp"); err != nil {
+		t.Fatal(err)
+	}
+	if udp, ok := cfg.(*v1.UDPProxyConfig); !ok || udp.RemotePort != 20161 {
+		t.Errorf("got %#v, want a udp proxy on port 20161", cfg)
+	}
+}
@@ -1,6 +1,9 @@
 package tunnel
 
 import (
+	"context"
+	"time"
+
 	"github.com/Fyve-Labs/tessa-daemon/internal/config"
 	"github.com/fatedier/frp/client"
 	v1 "github.com/fatedier/frp/pkg/config/v1"
@@ -8,18 +11,56 @@ import (
 )
 
 func NewService(conf *config.TunnelConfig) (*client.Service, error) {
+	return newService(conf, nil, nil)
+}
+
+// newService builds the frp client publishing proxyCfgs, reporting its connections to tracker when set.
+func newService(conf *config.TunnelConfig, tracker *statusTracker, proxyCfgs []v1.ProxyConfigurer) (*client.Service, error) {
+	clientCfg, err := clientConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	//proxyCfgs.Complete(clientCfg.User)
+	//if err := validation.ValidateProxyConfigurerForClient(proxyCfgs); err != nil {
+	//	return nil, err
+	//}
+
+	options := client.ServiceOptions{
+		Common:         clientCfg,
+		ProxyCfgs:      proxyCfgs,
+		VisitorCfgs:    nil,
+		ConfigFilePath: "",
+	}
+	if tracker != nil {
+		options.ConnectorCreator = func(ctx context.Context, cfg *v1.ClientCommonConfig) client.Connector {
+			return tracker.connector(client.NewConnector(ctx, cfg))
+		}
+	}
+
+	return client.NewService(options)
+}
+
+// clientConfig builds the frpc common config from the tunnel section, frp fills in what is unset.
+func clientConfig(conf *config.TunnelConfig) (*v1.ClientCommonConfig, error) {
 	enabled := true
 	clientCfg := &v1.ClientCommonConfig{
-		ServerAddr: "52.7.199.211",
-		ServerPort: 7000,
+		ServerAddr: conf.ServerAddr,
+		ServerPort: conf.ServerPort,
 		Transport: v1.ClientTransportConfig{
-			Protocol: "tcp",
+			Protocol:          conf.Protocol,
+			DialServerTimeout: seconds(conf.LoginTimeout),
+			ProxyURL:          conf.ProxyURL,
+			PoolCount:         conf.PoolCount,
+			HeartbeatInterval: seconds(conf.HeartbeatInterval),
+			HeartbeatTimeout:  seconds(conf.HeartbeatTimeout),
 			TLS: v1.TLSClientConfig{
 				Enable: &enabled,
 				TLSConfig: v1.TLSConfig{
 					CertFile:      conf.TLSCertFile,
 					KeyFile:       conf.TLSKeyFile,
 					TrustedCaFile: conf.TLSCaFile,
+					ServerName:    conf.TLSServerName,
 				},
 			},
 		},
@@ -33,15 +74,18 @@ func NewService(conf *config.TunnelConfig) (*client.Service, error) {
 		return nil, err
 	}
 
-	//proxyCfgs.Complete(clientCfg.User)
-	//if err := validation.ValidateProxyConfigurerForClient(proxyCfgs); err != nil {
-	//	return nil, err
-	//}
+	return clientCfg, nil
+}
 
-	return client.NewService(client.ServiceOptions{
-		Common:         clientCfg,
-		ProxyCfgs:      []v1.ProxyConfigurer{},
-		VisitorCfgs:    nil,
-		ConfigFilePath: "",
-	})
+// seconds converts a duration to the whole seconds frp expects, rounding up so short durations
+// are not mistaken for unset, and keeping negative values which disable a feature.
+func seconds(d time.Duration) int64 {
+	switch {
+	case d == 0:
+		return 0
+	case d < 0:
+		return -1
+	default:
+		return int64((d + time.Second - 1) / time.Second)
+	}
 }
@@ -0,0 +1,68 @@
+package tunnel
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Fyve-Labs/tessa-daemon/internal/config"
+)
+
+func TestClientConfig(t *testing.T) {
+	conf := &config.TunnelConfig{
+		ServerAddr:        "staging.example.com",
+		ServerPort:        7443,
+		Protocol:          "websocket",
+		TLSServerName:     "frps.example.com",
+		PoolCount:         4,
+		HeartbeatInterval: 20 * time.Second,
+		HeartbeatTimeout:  60500 * time.Millisecond,
+		LoginTimeout:      time.Minute,
+		ProxyURL:          "socks5://proxy:1080",
+		TLSCaFile:         "ca.crt",
+	}
+
+	cfg, err := clientConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.ServerAddr != "staging.example.com" || cfg.ServerPort != 7443 {
+		t.Errorf("server = %s:%d", cfg.ServerAddr, cfg.ServerPort)
+	}
+
+	transport := cfg.Transport
+	if transport.Protocol != "websocket" || transport.PoolCount != 4 || transport.ProxyURL != "socks5://proxy:1080" {
+		t.Errorf("transport = %+v", transport)
+	}
+	if transport.HeartbeatInterval != 20 || transport.HeartbeatTimeout != 61 || transport.DialServerTimeout != 60 {
+		t.Errorf("heartbeat %d/%ds, dial timeout %ds", transport.HeartbeatInterval, transport.HeartbeatTimeout, transport.DialServerTimeout)
+	}
+	if !*transport.TLS.Enable || transport.TLS.ServerName != "frps.example.com" || transport.TLS.TrustedCaFile != "ca.crt" {
+		t.Errorf("TLS = %+v", transport.TLS)
+	}
+}
+
+func TestClientConfigDefaults(t *testing.T) {
+	cfg, err := clientConfig(&config.TunnelConfig{ServerAddr: "tunnel.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.ServerPort != 7000 || cfg.Transport.Protocol != "tcp" || cfg.Transport.PoolCount != 1 {
+		t.Errorf("frp defaults not applied: port %d, protocol %s, pool %d", cfg.ServerPort, cfg.Transport.Protocol, cfg.Transport.PoolCount)
+	}
+	if cfg.Transport.HeartbeatInterval != -1 {
+		t.Errorf("heartbeats enabled by default")
+	}
+}
+
+func TestClientConfigInvalid(t *testing.T) {
+	_, err := clientConfig(&config.TunnelConfig{
+		ServerAddr:        "tunnel.example.com",
+		HeartbeatInterval: 30 * time.Second,
+		HeartbeatTimeout:  10 * time.Second,
+	})
+	if err == nil {
+		t.Error("heartbeat timeout shorter than the interval accepted")
+	}
+}
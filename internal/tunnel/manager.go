@@ -5,105 +5,321 @@ import (
 	"fmt"
 	"log/slog"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/Fyve-Labs/tessa-daemon/internal/config"
 	"github.com/fatedier/frp/client"
 	v1 "github.com/fatedier/frp/pkg/config/v1"
+	"github.com/pkg/errors"
 	"github.com/pocketbase/pocketbase/tools/store"
 )
 
+const (
+	// restartMinBackoff and restartMaxBackoff bound the wait before frpc is started again after it
+	// gave up connecting to the tunnel server.
+	restartMinBackoff = time.Second
+	restartMaxBackoff = time.Minute
+)
+
+// Manager publishes local ports through the tunnel server. Proxy changes are recorded by the
+// caller and applied by a single supervisor goroutine, which owns the frp client.
 type Manager struct {
 	deviceName string
-	frpc       *client.Service
+	serverAddr string
+	conf       *config.TunnelConfig
+	frpc       atomic.Pointer[client.Service] // Running frp client, nil while stopped. Only the supervisor sets it
 	proxyCfgs  *store.Store[string, v1.ProxyConfigurer]
-	cancel     context.CancelFunc
+	services   *store.Store[string, *Service] // Exposed services by name, their proxies are in proxyCfgs
+	status     *statusTracker
+
+	changes  chan struct{} // Wakes the supervisor to apply the proxies
+	quit     chan struct{} // Closed by Stop
+	stopOnce sync.Once
+	done     chan struct{} // Closed once the supervisor stopped the frp client
+
+	mu sync.Mutex // Serializes proxy changes, commands call in from their own goroutines
 }
 
 func NewManager(deviceName string, conf *config.TunnelConfig) (*Manager, error) {
-	frpc, err := NewService(conf)
-	if err != nil {
+	// Fail on a bad config now rather than in the supervisor
+	if _, err := clientConfig(conf); err != nil {
 		return nil, err
 	}
 
-	return &Manager{
+	m := &Manager{
 		deviceName: deviceName,
-		frpc:       frpc,
+		serverAddr: conf.ServerAddr,
+		conf:       conf,
 		proxyCfgs:  store.New(map[string]v1.ProxyConfigurer{}),
-	}, nil
+		services:   store.New(map[string]*Service{}),
+		status:     &statusTracker{},
+		changes:    make(chan struct{}, 1),
+		quit:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+
+	go m.supervise()
+	go m.watchStatus(m.done)
+
+	return m, nil
+}
+
+// ErrProxyNameInUse is returned when a proxy name is already taken by another local address,
+// frp would keep only one of the two.
+var ErrProxyNameInUse = errors.New("tunnel proxy name is already in use")
+
+// ProxySSH publishes the device SSH server under the device name.
+func (m *Manager) ProxySSH(IP string, port int) error {
+	_, err := m.Proxy("", IP, port, true)
+	return err
 }
 
-func (m *Manager) ProxySSH(IP string, port int) {
+// Proxy publishes a local port as a tcpmux proxy. The proxy name and its domain are the
+// device name, suffixed with "-<name>" when name is set. With proxyProtocol, connections
+// start with a PROXY protocol v2 header carrying the client address. It returns the proxy domain.
+func (m *Manager) Proxy(name string, IP string, port int, proxyProtocol bool) (string, error) {
+	proxyName := m.proxyName(name)
+
 	proxyCfg := &v1.TCPMuxProxyConfig{
 		ProxyBaseConfig: v1.ProxyBaseConfig{
 			Type: "tcpmux",
-			Name: m.deviceName,
+			Name: proxyName,
 			ProxyBackend: v1.ProxyBackend{
 				LocalIP:   IP,
 				LocalPort: port,
 			},
 		},
 		DomainConfig: v1.DomainConfig{
-			CustomDomains: []string{m.deviceName},
+			CustomDomains: []string{proxyName},
 		},
 		Multiplexer: "httpconnect",
 	}
+	if proxyProtocol {
+		proxyCfg.Transport.ProxyProtocolVersion = "v2"
+	}
 
-	m.proxyCfgs.Set(net.JoinHostPort(IP, fmt.Sprintf("%d", port)), proxyCfg)
-	if err := m.update(); err != nil {
-		slog.Warn(err.Error())
+	if err := m.setProxy(net.JoinHostPort(IP, fmt.Sprintf("%d", port)), proxyCfg); err != nil {
+		return "", err
 	}
+
+	return proxyName, nil
+}
+
+// Types of secret proxies.
+const (
+	SecretSTCP = "stcp"
+	SecretXTCP = "xtcp"
+)
+
+// SecretProxy makes a proxy reachable only by frp visitors that know its secret key.
+type SecretProxy struct {
+	// Type is stcp, or xtcp for visitors to try a peer-to-peer connection first.
+	Type      string
+	SecretKey string
+	// AllowUsers lists the frp users whose visitors may connect, "*" allows every user and empty
+	// only the device's own frp user.
+	AllowUsers []string
+}
+
+// ProxySecret publishes a local port as an stcp or xtcp proxy named like Proxy does. With
+// proxyProtocol, connections start with a PROXY protocol v2 header. It returns the proxy name,
+// which visitors use as their server name.
+func (m *Manager) ProxySecret(name string, IP string, port int, proxyProtocol bool, secret *SecretProxy) (string, error) {
+	proxyName := m.proxyName(name)
+	base := v1.ProxyBaseConfig{
+		Type: secret.Type,
+		Name: proxyName,
+		ProxyBackend: v1.ProxyBackend{
+			LocalIP:   IP,
+			LocalPort: port,
+		},
+	}
+	if proxyProtocol {
+		base.Transport.ProxyProtocolVersion = "v2"
+	}
+
+	var proxyCfg v1.ProxyConfigurer
+	if secret.Type == SecretXTCP {
+		proxyCfg = &v1.XTCPProxyConfig{ProxyBaseConfig: base, Secretkey: secret.SecretKey, AllowUsers: secret.AllowUsers}
+	} else {
+		proxyCfg = &v1.STCPProxyConfig{ProxyBaseConfig: base, Secretkey: secret.SecretKey, AllowUsers: secret.AllowUsers}
+	}
+
+	if err := m.setProxy(net.JoinHostPort(IP, fmt.Sprintf("%d", port)), proxyCfg); err != nil {
+		return "", err
+	}
+
+	return proxyName, nil
+}
+
+// proxyName is the device name, suffixed with "-<name>" when name is set.
+func (m *Manager) proxyName(name string) string {
+	if name == "" {
+		return m.deviceName
+	}
+
+	return fmt.Sprintf("%s-%s", m.deviceName, name)
+}
+
+// ProxyTCP publishes a local port as a plain tcp proxy on remotePort of the tunnel server, for
+// clients that cannot go through the tcpmux HTTP CONNECT multiplexer. It returns the tunnel server address.
+func (m *Manager) ProxyTCP(name string, IP string, port int, remotePort int) (string, error) {
+	proxyName := m.proxyName(name)
+
+	proxyCfg := &v1.TCPProxyConfig{
+		ProxyBaseConfig: v1.ProxyBaseConfig{
+			Type: "tcp",
+			Name: proxyName,
+			ProxyBackend: v1.ProxyBackend{
+				LocalIP:   IP,
+				LocalPort: port,
+			},
+		},
+		RemotePort: remotePort,
+	}
+
+	if err := m.setProxy(net.JoinHostPort(IP, fmt.Sprintf("%d", port)), proxyCfg); err != nil {
+		return "", err
+	}
+
+	return m.serverAddr, nil
+}
+
+// setProxy publishes proxyCfg for the local address key, replacing the proxy of that address.
+func (m *Manager) setProxy(key string, proxyCfg v1.ProxyConfigurer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.checkProxyName(key, proxyCfg.GetBaseConfig().Name); err != nil {
+		return err
+	}
+
+	m.proxyCfgs.Set(key, proxyCfg)
+	m.changed()
+
+	return nil
+}
+
+// checkProxyName fails if name is taken by a proxy other than the one stored under key. The
+// caller must hold m.mu.
+func (m *Manager) checkProxyName(key string, name string) error {
+	for k, cfg := range m.proxyCfgs.GetAll() {
+		if k != key && cfg.GetBaseConfig().Name == name {
+			return fmt.Errorf("%w: %s", ErrProxyNameInUse, name)
+		}
+	}
+
+	return nil
 }
 
 func (m *Manager) UnProxy(IP string, port int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	m.proxyCfgs.Remove(net.JoinHostPort(IP, fmt.Sprintf("%d", port)))
-	if err := m.update(); err != nil {
-		slog.Error(err.Error())
+	m.changed()
+}
+
+// changed wakes the supervisor, changes made before it gets to them are applied together.
+func (m *Manager) changed() {
+	select {
+	case m.changes <- struct{}{}:
+	default:
 	}
 }
 
-func (m *Manager) update() error {
-	reload := func() error {
-		var proxyCfgs []v1.ProxyConfigurer
-		for _, cfg := range m.proxyCfgs.GetAll() {
-			proxyCfgs = append(proxyCfgs, cfg)
-		}
+// supervise starts the frp client when there are proxies to publish, applies proxy changes to it
+// and stops it when the last proxy is removed. When the client gives up connecting it is started
+// again with exponential backoff. A closed frp client cannot run again, so every start builds a
+// new one.
+func (m *Manager) supervise() {
+	defer close(m.done)
+
+	var (
+		cancel  context.CancelFunc
+		exited  chan error       // Receives the outcome of the running client
+		retry   <-chan time.Time // Fires when a client that gave up may start again
+		backoff = restartMinBackoff
+	)
 
-		return m.frpc.UpdateAllConfigurer(proxyCfgs, nil)
+	stopClient := func() {
+		if m.frpc.Load() != nil {
+			cancel()
+			<-exited // Cancelling during login fails it, that is no error here
+			m.frpc.Store(nil)
+		}
+		m.status.stopped(nil)
 	}
 
-	// not started yet
-	if m.cancel == nil {
-		if m.proxyCfgs.Length() > 0 {
-			ctx, cancel := context.WithCancel(context.Background())
-			go func() {
-				if err := m.frpc.Run(ctx); err != nil {
-					cancel()
-					m.cancel = nil
-				}
-			}()
+	restartLater := func(err error) {
+		slog.Error(fmt.Sprintf("tunnel failed: %v; restarting in %s", err, backoff))
+		m.status.stopped(err)
+		m.status.retrying(time.Now().Add(backoff))
+		retry = time.After(backoff)
+		backoff = min(backoff*2, restartMaxBackoff)
+	}
 
-			m.cancel = cancel
-			return reload()
+	for {
+		select {
+		case <-m.quit:
+			stopClient()
+			return
+		case <-m.changes:
+		case <-retry:
+			retry = nil
+		case err := <-exited:
+			cancel()
+			m.frpc.Store(nil)
+			restartLater(err)
+			continue
 		}
 
-		return nil
+		proxyCfgs := m.proxyCfgs.Values()
+		frpc := m.frpc.Load()
+		switch {
+		case len(proxyCfgs) == 0:
+			stopClient()
+			retry, backoff = nil, restartMinBackoff
+		case frpc != nil:
+			if err := frpc.UpdateAllConfigurer(proxyCfgs, nil); err != nil {
+				slog.Error(fmt.Sprintf("update tunnel proxies: %v", err))
+			}
+		case retry == nil:
+			var err error
+			if cancel, exited, err = m.start(proxyCfgs); err != nil {
+				restartLater(errors.Wrap(err, "create client"))
+			}
+		}
 	}
+}
 
-	// Already started, check if we need to restart
-	if m.proxyCfgs.Length() == 0 {
-		m.Stop()
-		return nil
+// start runs a new frp client publishing proxyCfgs. It returns the function stopping the client
+// and the channel receiving why it exited.
+func (m *Manager) start(proxyCfgs []v1.ProxyConfigurer) (context.CancelFunc, chan error, error) {
+	frpc, err := newService(m.conf, m.status, proxyCfgs)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return reload()
+	ctx, cancel := context.WithCancel(context.Background())
+	exited := make(chan error, 1)
+
+	m.status.started()
+	m.frpc.Store(frpc)
+	go func() {
+		exited <- frpc.Run(ctx)
+	}()
+
+	return cancel, exited, nil
 }
 
+// Stop closes every proxy and waits for the frp client to stop. The manager cannot be used afterwards.
 func (m *Manager) Stop() {
-	if m.cancel == nil {
-		return
-	}
+	m.stopOnce.Do(func() {
+		close(m.quit)
+	})
 
-	m.frpc.Close()
-	m.cancel()
-	m.cancel = nil
+	<-m.done
 }
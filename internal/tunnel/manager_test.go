@@ -0,0 +1,121 @@
+package tunnel
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Fyve-Labs/tessa-daemon/internal/config"
+)
+
+// newRefusedManager returns a manager whose tunnel server refuses connections.
+func newRefusedManager(t *testing.T) *Manager {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	_ = l.Close()
+
+	m, err := NewManager("my-device", &config.TunnelConfig{ServerAddr: "127.0.0.1", ServerPort: port, Protocol: "tcp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(m.Stop)
+
+	return m
+}
+
+func waitStatus(t *testing.T, m *Manager, what string, ok func(*Status) bool) *Status {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status := m.Status()
+		if ok(status) {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: %+v", what, status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestManagerRestartsFailedClient(t *testing.T) {
+	m := newRefusedManager(t)
+	m.ProxyTCP("mqtt", "127.0.0.1", 1883, 21883)
+
+	failed := waitStatus(t, m, "frpc did not fail", func(s *Status) bool {
+		return s.State == StateFailed && s.RetryAt != nil
+	})
+
+	// The restarted client makes new attempts, counted with the earlier ones
+	waitStatus(t, m, "frpc was not restarted", func(s *Status) bool {
+		return s.ConnectAttempts > failed.ConnectAttempts
+	})
+
+	m.UnProxy("127.0.0.1", 1883)
+	waitStatus(t, m, "tunnel did not stop", func(s *Status) bool {
+		return s.State == StateStopped && s.ConnectAttempts == 0
+	})
+}
+
+func TestManagerStartStopCycles(t *testing.T) {
+	m := newRefusedManager(t)
+
+	for i := 0; i < 20; i++ {
+		m.Proxy("ssh", "127.0.0.1", 2222, false)
+		m.Status()
+		m.UnProxy("127.0.0.1", 2222)
+	}
+	waitStatus(t, m, "tunnel did not stop", func(s *Status) bool {
+		return s.State == StateStopped
+	})
+
+	// A stopped client is replaced by a new one
+	m.Proxy("ssh", "127.0.0.1", 2222, false)
+	waitStatus(t, m, "tunnel did not start", func(s *Status) bool {
+		return s.ConnectAttempts > 0
+	})
+
+	m.Stop()
+	if status := m.Status(); status.State != StateStopped {
+		t.Fatalf("state %s after Stop, want stopped", status.State)
+	}
+	m.Stop()
+}
+
+func TestProxyNameInUse(t *testing.T) {
+	m := newRefusedManager(t)
+
+	if _, err := m.Proxy("beszel", "127.0.0.1", 2222, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Republishing the same local port replaces its proxy
+	if _, err := m.Proxy("beszel", "127.0.0.1", 2222, true); err != nil {
+		t.Errorf("republishing a port: %v", err)
+	}
+
+	if _, err := m.ProxyTCP("beszel", "127.0.0.1", 45876, 45876); !errors.Is(err, ErrProxyNameInUse) {
+		t.Errorf("ProxyTCP with a name in use: got %v, want ErrProxyNameInUse", err)
+	}
+	if _, err := m.ProxySecret("beszel", "127.0.0.1", 45876, false, &SecretProxy{Type: SecretSTCP, SecretKey: "k"}); !errors.Is(err, ErrProxyNameInUse) {
+		t.Errorf("ProxySecret with a name in use: got %v, want ErrProxyNameInUse", err)
+	}
+	if _, err := m.Expose(Service{Name: "beszel", Type: ServiceTCP, LocalPort: 45876, RemotePort: 45876}); !errors.Is(err, ErrProxyNameInUse) {
+		t.Errorf("Expose with a name in use: got %v, want ErrProxyNameInUse", err)
+	}
+	if status := m.Status(); len(status.Proxies) != 1 {
+		t.Fatalf("%d proxies after rejected names, want 1", len(status.Proxies))
+	}
+
+	m.UnProxy("127.0.0.1", 2222)
+	if _, err := m.ProxyTCP("beszel", "127.0.0.1", 45876, 45876); err != nil {
+		t.Errorf("name not released by UnProxy: %v", err)
+	}
+}
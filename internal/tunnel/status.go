@@ -0,0 +1,284 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fatedier/frp/client"
+	"github.com/fatedier/frp/client/proxy"
+	v1 "github.com/fatedier/frp/pkg/config/v1"
+)
+
+// Connection states of the tunnel.
+const (
+	StateStopped    = "stopped" // Nothing to publish, frpc is not running
+	StateConnecting = "connecting"
+	StateConnected  = "connected"
+	StateFailed     = "failed" // frpc gave up, see Error
+)
+
+// Proxy states.
+const (
+	ProxyNew     = "new" // Not registered with the tunnel server yet
+	ProxyRunning = "running"
+	ProxyError   = "error"
+)
+
+// statusInterval is how often the frpc state is polled for changes.
+const statusInterval = time.Second
+
+// Status describes the tunnel connection and its proxies.
+type Status struct {
+	State string `json:"state"`
+	// Error is why the last connection attempt failed, or why frpc gave up.
+	Error string `json:"error,omitempty"`
+	// ConnectAttempts counts the connection attempts since the tunnel was last connected,
+	// across frpc restarts.
+	ConnectAttempts int        `json:"connect_attempts"`
+	ConnectedSince  *time.Time `json:"connected_since,omitempty"`
+	// RetryAt is when frpc is started again after it failed.
+	RetryAt *time.Time     `json:"retry_at,omitempty"`
+	Proxies []*ProxyStatus `json:"proxies,omitempty"`
+}
+
+// ProxyStatus describes a proxy as the tunnel server sees it.
+type ProxyStatus struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// RemoteAddr is the address the tunnel server publishes the proxy on.
+	RemoteAddr string `json:"remote_addr,omitempty"`
+}
+
+// statusTracker follows frpc through its connections to the tunnel server.
+type statusTracker struct {
+	mu             sync.Mutex
+	running        bool
+	runErr         string
+	attempts       int
+	lastErr        string
+	conn           *trackedConnector // Connection frpc logged in on, nil while disconnected
+	connectedSince time.Time
+	retryAt        time.Time // When frpc starts again after it failed, zero if it does not
+	onChange       func(*Status)
+}
+
+func (t *statusTracker) started() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.running, t.runErr, t.retryAt = true, "", time.Time{}
+}
+
+// stopped records that frpc exited, failing with err. Without an error the tunnel was stopped
+// on purpose and its connection history is cleared.
+func (t *statusTracker) stopped(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.running, t.conn, t.retryAt = false, nil, time.Time{}
+	if err != nil {
+		t.runErr = err.Error()
+	} else {
+		t.runErr, t.attempts, t.lastErr = "", 0, ""
+	}
+}
+
+func (t *statusTracker) retrying(at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.retryAt = at.UTC()
+}
+
+// connector wraps the frpc connector so connection attempts, failures and disconnects are seen.
+func (t *statusTracker) connector(c client.Connector) client.Connector {
+	return &trackedConnector{Connector: c, tracker: t}
+}
+
+func (t *statusTracker) failed(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.lastErr = err.Error()
+}
+
+func (t *statusTracker) setConn(c *trackedConnector, connected bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch {
+	case connected:
+		t.conn, t.attempts, t.lastErr, t.connectedSince = c, 0, "", time.Now().UTC()
+	case t.conn == c:
+		t.conn = nil
+	}
+}
+
+// trackedConnector reports the connections of one login attempt, the first connection made is
+// the control connection frpc logs in on.
+type trackedConnector struct {
+	client.Connector
+	tracker *statusTracker
+	once    sync.Once
+}
+
+func (c *trackedConnector) Open() error {
+	c.tracker.mu.Lock()
+	c.tracker.attempts++
+	c.tracker.mu.Unlock()
+
+	err := c.Connector.Open()
+	if err != nil {
+		c.tracker.failed(err)
+	}
+
+	return err
+}
+
+func (c *trackedConnector) Connect() (net.Conn, error) {
+	conn, err := c.Connector.Connect()
+	c.once.Do(func() {
+		if err != nil {
+			c.tracker.failed(err)
+		} else {
+			c.tracker.setConn(c, true)
+		}
+	})
+
+	return conn, err
+}
+
+func (c *trackedConnector) Close() error {
+	c.tracker.setConn(c, false)
+	return c.Connector.Close()
+}
+
+// OnStatusChange sets a function called with the new status whenever the tunnel connection or
+// one of its proxies changes state.
+func (m *Manager) OnStatusChange(fn func(*Status)) {
+	m.status.mu.Lock()
+	defer m.status.mu.Unlock()
+
+	m.status.onChange = fn
+}
+
+// Status returns the state of the tunnel connection and its proxies.
+func (m *Manager) Status() *Status {
+	status := m.connStatus()
+	for _, cfg := range m.proxyCfgs.GetAll() {
+		status.Proxies = append(status.Proxies, m.proxyStatus(cfg.GetBaseConfig(), status))
+	}
+	sort.Slice(status.Proxies, func(i, j int) bool {
+		return status.Proxies[i].Name < status.Proxies[j].Name
+	})
+
+	return status
+}
+
+// connStatus returns the state of the tunnel connection, without its proxies.
+func (m *Manager) connStatus() *Status {
+	t := m.status
+	t.mu.Lock()
+	status := &Status{ConnectAttempts: t.attempts, Error: t.lastErr}
+	switch {
+	case !t.running && t.runErr != "":
+		status.State, status.Error = StateFailed, t.runErr
+		if !t.retryAt.IsZero() {
+			retryAt := t.retryAt
+			status.RetryAt = &retryAt
+		}
+	case !t.running:
+		status.State = StateStopped
+	case t.conn != nil:
+		status.State = StateConnected
+		connectedSince := t.connectedSince
+		status.ConnectedSince = &connectedSince
+	default:
+		status.State = StateConnecting
+	}
+	t.mu.Unlock()
+
+	return status
+}
+
+// ProxyStatus returns the state of the proxy publishing IP:port, or nil if there is none.
+func (m *Manager) ProxyStatus(IP string, port int) *ProxyStatus {
+	cfg, ok := m.proxyCfgs.GetOk(net.JoinHostPort(IP, fmt.Sprintf("%d", port)))
+	if !ok {
+		return nil
+	}
+
+	return m.proxyStatus(cfg.GetBaseConfig(), m.connStatus())
+}
+
+func (m *Manager) proxyStatus(cfg *v1.ProxyBaseConfig, tunnel *Status) *ProxyStatus {
+	status := &ProxyStatus{Name: cfg.Name, Type: cfg.Type, Status: ProxyNew}
+	if tunnel.State != StateConnected {
+		// Proxies wait for the tunnel, tell why it is not up
+		status.Error = tunnel.Error
+		if tunnel.State == StateFailed {
+			status.Status = ProxyError
+		}
+		return status
+	}
+
+	frpc := m.frpc.Load()
+	if frpc == nil {
+		return status
+	}
+
+	working, ok := frpc.StatusExporter().GetProxyStatus(cfg.Name)
+	if !ok {
+		return status
+	}
+
+	switch working.Phase {
+	case proxy.ProxyPhaseRunning:
+		status.Status = ProxyRunning
+		status.RemoteAddr = working.RemoteAddr
+	case proxy.ProxyPhaseStartErr, proxy.ProxyPhaseCheckFailed:
+		status.Status, status.Error = ProxyError, working.Err
+	}
+
+	return status
+}
+
+// watchStatus reports status changes until done is closed, then reports the final status.
+func (m *Manager) watchStatus(done <-chan struct{}) {
+	ticker := time.NewTicker(statusInterval)
+	defer ticker.Stop()
+
+	var last *Status
+	report := func() {
+		status := m.Status()
+		if reflect.DeepEqual(status, last) {
+			return
+		}
+		last = status
+
+		m.status.mu.Lock()
+		onChange := m.status.onChange
+		m.status.mu.Unlock()
+
+		if onChange != nil {
+			onChange(status)
+		}
+	}
+
+	report()
+	for {
+		select {
+		case <-done:
+			report()
+			return
+		case <-ticker.C:
+			report()
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package tunnel
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Fyve-Labs/tessa-daemon/internal/config"
+	v1 "github.com/fatedier/frp/pkg/config/v1"
+	"github.com/pocketbase/pocketbase/tools/store"
+)
+
+type fakeConnector struct {
+	openErr    error
+	connectErr error
+}
+
+func (c *fakeConnector) Open() error { return c.openErr }
+
+func (c *fakeConnector) Connect() (net.Conn, error) {
+	if c.connectErr != nil {
+		return nil, c.connectErr
+	}
+
+	conn, _ := net.Pipe()
+	return conn, nil
+}
+
+func (c *fakeConnector) Close() error { return nil }
+
+func newTestManager(t *testing.T) *Manager {
+	t.Helper()
+
+	status := &statusTracker{}
+	frpc, err := newService(&config.TunnelConfig{ServerAddr: "127.0.0.1"}, status, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &Manager{
+		deviceName: "my-device",
+		proxyCfgs:  store.New(map[string]v1.ProxyConfigurer{}),
+		services:   store.New(map[string]*Service{}),
+		status:     status,
+	}
+	m.frpc.Store(frpc)
+	m.proxyCfgs.Set("127.0.0.1:2222", &v1.TCPMuxProxyConfig{ProxyBaseConfig: v1.ProxyBaseConfig{Name: "my-device", Type: "tcpmux"}})
+
+	return m
+}
+
+func TestStatus(t *testing.T) {
+	m := newTestManager(t)
+	if status := m.Status(); status.State != StateStopped {
+		t.Fatalf("state %s before start, want stopped", status.State)
+	}
+
+	m.status.started()
+
+	refused := m.status.connector(&fakeConnector{openErr: errors.New("connection refused")})
+	_ = refused.Open()
+	_ = refused.Close()
+	status := m.Status()
+	if status.State != StateConnecting || status.ConnectAttempts != 1 || status.Error != "connection refused" {
+		t.Fatalf("after a failed attempt: %+v", status)
+	}
+	if proxy := m.ProxyStatus("127.0.0.1", 2222); proxy.Status != ProxyNew || proxy.Error != "connection refused" {
+		t.Errorf("proxy while connecting: %+v", proxy)
+	}
+
+	connector := m.status.connector(&fakeConnector{})
+	_ = connector.Open()
+	if _, err := connector.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	status = m.Status()
+	if status.State != StateConnected || status.ConnectAttempts != 0 || status.Error != "" || status.ConnectedSince == nil {
+		t.Fatalf("after connecting: %+v", status)
+	}
+	if len(status.Proxies) != 1 || status.Proxies[0].Name != "my-device" || status.Proxies[0].Status != ProxyNew {
+		t.Errorf("proxies %+v", status.Proxies)
+	}
+
+	// Later connections are work connections, they do not change the login state
+	if _, err := connector.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if status = m.Status(); status.State != StateConnected {
+		t.Fatalf("state %s after a work connection", status.State)
+	}
+
+	_ = connector.Close()
+	if status = m.Status(); status.State != StateConnecting {
+		t.Fatalf("state %s after the connection closed, want connecting", status.State)
+	}
+
+	m.status.stopped(errors.New("login to the server failed"))
+	status = m.Status()
+	if status.State != StateFailed || status.Error != "login to the server failed" {
+		t.Fatalf("after frpc gave up: %+v", status)
+	}
+	if proxy := m.ProxyStatus("127.0.0.1", 2222); proxy.Status != ProxyError || proxy.Error != "login to the server failed" {
+		t.Errorf("proxy after frpc gave up: %+v", proxy)
+	}
+	if m.ProxyStatus("127.0.0.1", 8080) != nil {
+		t.Error("status of a port that is not published")
+	}
+
+	_ = refused.Open()
+	m.status.retrying(time.Now().Add(time.Second))
+	if status = m.Status(); status.RetryAt == nil || status.ConnectAttempts != 1 {
+		t.Fatalf("while waiting to restart: %+v", status)
+	}
+
+	// Attempts add up across restarts until the tunnel connects or is stopped
+	m.status.started()
+	_ = refused.Open()
+	if status = m.Status(); status.State != StateConnecting || status.RetryAt != nil || status.ConnectAttempts != 2 {
+		t.Fatalf("after restarting: %+v", status)
+	}
+
+	m.status.stopped(nil)
+	if status = m.Status(); status.State != StateStopped || status.ConnectAttempts != 0 || status.Error != "" {
+		t.Fatalf("after stopping: %+v", status)
+	}
+}
+
+func TestWatchStatusReportsChanges(t *testing.T) {
+	m := newTestManager(t)
+
+	states := make(chan string, 10)
+	m.OnStatusChange(func(status *Status) {
+		states <- status.State
+	})
+
+	done := make(chan struct{})
+	m.status.started()
+	go m.watchStatus(done)
+
+	if state := <-states; state != StateConnecting {
+		t.Fatalf("first reported %s, want connecting", state)
+	}
+
+	m.status.stopped(errors.New("login to the server failed"))
+	close(done)
+
+	// The final status is reported once frpc has stopped
+	if state := <-states; state != StateFailed {
+		t.Fatalf("then reported %s, want failed", state)
+	}
+}